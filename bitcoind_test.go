@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+)
+
+// fakeBitcoind is a JSON-RPC server standing in for bitcoind. It answers single calls and batches.
+type fakeBitcoind struct {
+	server *httptest.Server
+
+	// call answers a single call. If it returns ok=false, the call is left out of a batch response.
+	call func(method string, params []json.RawMessage) (result interface{}, rpcErr *btcjson.RPCError, ok bool)
+
+	// status, if set, can fail a whole request with an HTTP status other than 200.
+	status func(batch bool, heights []int64) int
+
+	mu sync.Mutex
+	// Heights asked for in getblockstats calls, by request.
+	batches [][]int64
+	singles []int64
+}
+
+type fakeRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type fakeResponse struct {
+	ID     json.RawMessage   `json:"id"`
+	Result interface{}       `json:"result"`
+	Error  *btcjson.RPCError `json:"error"`
+}
+
+// newFakeBitcoind starts a fake bitcoind and points the RPC pools at it, without Postgres.
+func newFakeBitcoind(t *testing.T) *fakeBitcoind {
+	fake := &fakeBitcoind{
+		call: func(method string, params []json.RawMessage) (interface{}, *btcjson.RPCError, bool) {
+			if method != "getblockstats" {
+				return nil, &btcjson.RPCError{Code: btcjson.ErrRPCMisc, Message: "unexpected " + method}, true
+			}
+			var height int64
+			json.Unmarshal(params[0], &height)
+			return fakeBlockStats(height), nil, true
+		},
+	}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.serveHTTP))
+	t.Cleanup(fake.server.Close)
+
+	t.Setenv("BITCOIND_HOST", strings.TrimPrefix(fake.server.URL, "http://"))
+	USE_POSTGRES = false
+	RPC_POOL_SIZE = 2
+	setupPools()
+	t.Cleanup(closePools)
+
+	return fake
+}
+
+func fakeBlockStats(height int64) *btcjson.GetBlockStatsResult {
+	return &btcjson.GetBlockStatsResult{
+		Height: height,
+		Hash:   fmt.Sprintf("%064x", height),
+		Txs:    height%7 + 1,
+	}
+}
+
+func (fake *fakeBitcoind) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	batch := strings.HasPrefix(strings.TrimSpace(string(body)), "[")
+
+	var requests []fakeRequest
+	if batch {
+		json.Unmarshal(body, &requests)
+	} else {
+		var request fakeRequest
+		json.Unmarshal(body, &request)
+		requests = []fakeRequest{request}
+	}
+
+	heights := make([]int64, 0, len(requests))
+	for _, request := range requests {
+		if request.Method == "getblockstats" && len(request.Params) > 0 {
+			var height int64
+			json.Unmarshal(request.Params[0], &height)
+			heights = append(heights, height)
+		}
+	}
+
+	fake.mu.Lock()
+	if batch {
+		fake.batches = append(fake.batches, heights)
+	} else {
+		fake.singles = append(fake.singles, heights...)
+	}
+	fake.mu.Unlock()
+
+	if fake.status != nil {
+		if status := fake.status(batch, heights); status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+	}
+
+	responses := make([]fakeResponse, 0, len(requests))
+	for _, request := range requests {
+		result, rpcErr, ok := fake.call(request.Method, request.Params)
+		if !ok {
+			continue
+		}
+		responses = append(responses, fakeResponse{ID: request.ID, Result: result, Error: rpcErr})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if batch {
+		json.NewEncoder(w).Encode(responses)
+		return
+	}
+	if len(responses) == 0 {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+	if responses[0].Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(responses[0])
+}
+
+// requests returns the heights of all getblockstats calls so far, batched and single.
+func (fake *fakeBitcoind) requests() ([][]int64, []int64) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return append([][]int64(nil), fake.batches...), append([]int64(nil), fake.singles...)
+}
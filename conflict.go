@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// What to do when a row for a height that is already stored is inserted, see -on-conflict.
+const (
+	ON_CONFLICT_SKIP      = "skip"
+	ON_CONFLICT_OVERWRITE = "overwrite"
+	ON_CONFLICT_ERROR     = "error"
+)
+
+const ON_CONFLICT_DEFAULT = ON_CONFLICT_SKIP
+
+// checkOnConflict makes sure ON_CONFLICT is one of the values above.
+func checkOnConflict() error {
+	switch ON_CONFLICT {
+	case ON_CONFLICT_SKIP, ON_CONFLICT_OVERWRITE, ON_CONFLICT_ERROR:
+		return nil
+	}
+	return fmt.Errorf("-on-conflict must be %v, %v or %v, not %q", ON_CONFLICT_SKIP, ON_CONFLICT_OVERWRITE, ON_CONFLICT_ERROR, ON_CONFLICT)
+}
+
+// overwriteColumns returns the SET clause replacing every column but the keys with the incoming row.
+func overwriteColumns() string {
+	table := orm.GetTable(reflect.TypeOf(DashboardDataV2{}))
+
+	set := make([]string, 0, len(table.Fields))
+	for _, field := range table.Fields {
+		if field.SQLName == "id" || field.SQLName == "height" {
+			continue
+		}
+		set = append(set, fmt.Sprintf("%v = EXCLUDED.%v", field.SQLName, field.SQLName))
+	}
+
+	return strings.Join(set, ", ")
+}
+
+// conflictClause returns the ON CONFLICT clause for inserts into dashboard_data_v2 written as SQL, see upsertRows.
+func conflictClause() string {
+	switch ON_CONFLICT {
+	case ON_CONFLICT_SKIP:
+		return "ON CONFLICT (height) DO NOTHING"
+	case ON_CONFLICT_OVERWRITE:
+		return "ON CONFLICT (height) DO UPDATE SET " + overwriteColumns() + " WHERE dashboard_data_v2.version < EXCLUDED.version"
+	}
+	return ""
+}
+
+// upsertRows inserts rows into dashboard_data_v2, handling rows for heights that are already
+// stored according to ON_CONFLICT. Overwrite only replaces rows with an older version.
+// The rollups of the rows are updated in the same transaction.
+// Returns the number of rows written.
+func upsertRows(db *pg.DB, rows []DashboardDataV2) (int, error) {
+	var written int
+	err := db.RunInTransaction(func(tx *pg.Tx) error {
+		query := tx.Model(&rows)
+		switch ON_CONFLICT {
+		case ON_CONFLICT_SKIP:
+			query = query.OnConflict("(height) DO NOTHING")
+		case ON_CONFLICT_OVERWRITE:
+			query = query.OnConflict("(height) DO UPDATE").
+				Set(overwriteColumns()).
+				Where("dashboard_data_v2.version < EXCLUDED.version")
+		}
+
+		return updateRollups(tx, rowHeights(rows), func() error {
+			res, err := query.Insert()
+			if err != nil {
+				return err
+			}
+			written = res.RowsAffected()
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return written, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+func useOnConflict(t *testing.T, mode string) {
+	saved := ON_CONFLICT
+	t.Cleanup(func() { ON_CONFLICT = saved })
+	ON_CONFLICT = mode
+}
+
+func TestCheckOnConflict(t *testing.T) {
+	for _, mode := range []string{ON_CONFLICT_SKIP, ON_CONFLICT_OVERWRITE, ON_CONFLICT_ERROR} {
+		useOnConflict(t, mode)
+		if err := checkOnConflict(); err != nil {
+			t.Errorf("-on-conflict=%v: %v", mode, err)
+		}
+	}
+
+	useOnConflict(t, "replace")
+	if err := checkOnConflict(); err == nil {
+		t.Errorf("-on-conflict=replace was accepted")
+	}
+}
+
+func TestConflictClause(t *testing.T) {
+	overwrite := "ON CONFLICT (height) DO UPDATE SET " + overwriteColumns() + " WHERE dashboard_data_v2.version < EXCLUDED.version"
+
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{ON_CONFLICT_SKIP, "ON CONFLICT (height) DO NOTHING"},
+		{ON_CONFLICT_OVERWRITE, overwrite},
+		// Without a clause the unique index on height fails the insert.
+		{ON_CONFLICT_ERROR, ""},
+	}
+
+	for _, test := range tests {
+		useOnConflict(t, test.mode)
+		if got := conflictClause(); got != test.want {
+			t.Errorf("-on-conflict=%v: conflictClause() = %q, want %q", test.mode, got, test.want)
+		}
+	}
+}
+
+func TestOverwriteColumns(t *testing.T) {
+	set := make(map[string]bool)
+	for _, assignment := range strings.Split(overwriteColumns(), ", ") {
+		var column, excluded string
+		if _, err := fmt.Sscanf(assignment, "%s = EXCLUDED.%s", &column, &excluded); err != nil || column != excluded {
+			t.Fatalf("%q doesn't set a column to the incoming row's", assignment)
+		}
+		if set[column] {
+			t.Errorf("%v is set twice", column)
+		}
+		set[column] = true
+	}
+
+	// The keys stay, everything else is replaced, including the version the WHERE compares.
+	for _, field := range orm.GetTable(reflect.TypeOf(DashboardDataV2{})).Fields {
+		key := field.SQLName == "id" || field.SQLName == "height"
+		if set[field.SQLName] == key {
+			t.Errorf("%v is set: %v", field.SQLName, set[field.SQLName])
+		}
+	}
+	if !set["version"] {
+		t.Errorf("version isn't set")
+	}
+}
+
+// storableRow returns a row that can be stored in dashboard_data_v2, whose array columns are NOT NULL.
+func storableRow(height int64, hash string, version int64) DashboardDataV2 {
+	return DashboardDataV2{
+		Height:                      height,
+		Hash:                        hash,
+		Version:                     version,
+		Feerate_percentiles:         []int{},
+		Txs_by_output_count:         []int64{},
+		Dust_output_count:           []int64{},
+		Percent_txs_by_output_count: []float64{},
+		Dust_output_percentages:     []float64{},
+	}
+}
+
+// checkWriteFollowsOnConflict stores rows with write in each -on-conflict mode, over rows that are already stored.
+func checkWriteFollowsOnConflict(t *testing.T, write func(db *pg.DB, rows []DashboardDataV2) (int, error)) {
+	usePostgres(t)
+
+	saved := ROLLUPS
+	t.Cleanup(func() { ROLLUPS = saved })
+	ROLLUPS = false
+
+	// Far above any real height, so the scratch database can hold other rows too.
+	const base = 900000000
+	clear := func() {
+		_, err := pgPool.Exec("DELETE FROM dashboard_data_v2 WHERE height >= ?", base)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	clear()
+	t.Cleanup(clear)
+
+	storedHash := func(height int64) string {
+		var hash string
+		_, err := pgPool.QueryOne(pg.Scan(&hash), "SELECT hash FROM dashboard_data_v2 WHERE height = ?", height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	useOnConflict(t, ON_CONFLICT_SKIP)
+	if _, err := write(pgPool, []DashboardDataV2{storableRow(base+1, "stored", 2)}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		mode        string
+		rows        []DashboardDataV2
+		wantWritten int
+		wantErr     bool
+		wantHash    string
+	}{
+		{ON_CONFLICT_SKIP, []DashboardDataV2{storableRow(base+1, "skipped", 3), storableRow(base+2, "new", 3)}, 1, false, "stored"},
+		{ON_CONFLICT_ERROR, []DashboardDataV2{storableRow(base+1, "failed", 3), storableRow(base+3, "new", 3)}, 0, true, "stored"},
+		{ON_CONFLICT_OVERWRITE, []DashboardDataV2{storableRow(base+1, "overwritten", 3)}, 1, false, "overwritten"},
+		// Rows are only overwritten by newer versions.
+		{ON_CONFLICT_OVERWRITE, []DashboardDataV2{storableRow(base+1, "same version", 3)}, 0, false, "overwritten"},
+	}
+
+	for _, test := range tests {
+		useOnConflict(t, test.mode)
+		written, err := write(pgPool, test.rows)
+		if (err != nil) != test.wantErr || written != test.wantWritten {
+			t.Errorf("-on-conflict=%v: wrote %v rows, error %v, want %v rows, error %v", test.mode, written, err, test.wantWritten, test.wantErr)
+		}
+		if hash := storedHash(base + 1); hash != test.wantHash {
+			t.Errorf("-on-conflict=%v: stored hash %q, want %q", test.mode, hash, test.wantHash)
+		}
+	}
+
+	// The failed write stored nothing at all.
+	var stored []int64
+	_, err := pgPool.Query(&stored, "SELECT height FROM dashboard_data_v2 WHERE height >= ? ORDER BY height", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(stored) != fmt.Sprint([]int64{base + 1, base + 2}) {
+		t.Errorf("stored heights: %v, want %v and %v", stored, base+1, base+2)
+	}
+}
+
+func TestUpsertRowsFollowsOnConflict(t *testing.T) {
+	checkWriteFollowsOnConflict(t, upsertRows)
+}
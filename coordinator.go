@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+const LEASE_DURATION_DEFAULT = 10 * time.Minute
+
+// How long to wait before checking for expired leases when all remaining chunks are leased.
+const LEASE_POLL_INTERVAL = 30 * time.Second
+
+// BackfillChunk is a chunk of a distributed backfill. Processes lease a chunk
+// by setting Owner and Lease_expires, and renew the lease whenever they record progress.
+// A chunk whose lease expired can be taken over by any other process.
+// Chunks belong to a backfill, see backfillID.
+type BackfillChunk struct {
+	tableName struct{} `sql:"backfill_chunks"`
+
+	Backfill_id  string `sql:",pk"`
+	Start_height int64  `sql:",pk"`
+	End_height   int64  `sql:",notnull"`
+	Last_height  int64  `sql:",notnull"`
+
+	Owner         string
+	Lease_expires time.Time
+	Done          bool `sql:",notnull"`
+}
+
+// pgChunks is a chunkSource that keeps the chunk queue and progress in Postgres,
+// so several processes (each with their own bitcoind) can work on one backfill.
+type pgChunks struct {
+	db    *pg.DB
+	owner string
+}
+
+// backfillID names the backfill of the given chunks. Processes started with the same range
+// and chunk size get the same id, so they work on the same chunks.
+func backfillID(split []heightRange) string {
+	hash := sha1.New()
+	for _, r := range split {
+		fmt.Fprintf(hash, "%v-%v,", r.Start, r.End)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))[:12]
+}
+
+// newPgChunks adds chunks for the given ranges to the backfill_chunks table.
+// If the same backfill is still running its chunks are left as they are, so any number of processes
+// can be started with the same range, or with no range at all to just help out.
+// A backfill that already finished is started over.
+func newPgChunks(ranges []heightRange) *pgChunks {
+	db := pgPool
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		fatal("Error getting hostname: ", err)
+	}
+
+	split := splitRanges(ranges)
+	if len(split) > 0 {
+		id := backfillID(split)
+		chunks := make([]BackfillChunk, len(split))
+		for i, r := range split {
+			chunks[i] = BackfillChunk{
+				Backfill_id:  id,
+				Start_height: r.Start,
+				End_height:   r.End,
+				Last_height:  r.Start,
+			}
+		}
+
+		var added int
+		err := db.RunInTransaction(func(tx *pg.Tx) error {
+			_, err := tx.Exec(`
+				DELETE FROM backfill_chunks WHERE backfill_id = ?0
+				AND NOT EXISTS (SELECT 1 FROM backfill_chunks WHERE backfill_id = ?0 AND NOT done)`, id)
+			if err != nil {
+				return err
+			}
+
+			res, err := tx.Model(&chunks).OnConflict("DO NOTHING").Insert()
+			if err != nil {
+				return err
+			}
+			added = res.RowsAffected()
+			return nil
+		})
+		if err != nil {
+			fatal("Error adding backfill chunks: ", err)
+		}
+		log.Printf("Added %v of %v chunks to backfill %v\n", added, len(split), id)
+	}
+
+	return &pgChunks{
+		db:    db,
+		owner: fmt.Sprintf("%v-%v", hostname, os.Getpid()),
+	}
+}
+
+// next leases the lowest chunk that is neither done nor leased by a live process.
+// If all remaining chunks are leased it waits, in case one of the leases expires.
+func (source *pgChunks) next() (*chunk, bool) {
+	for {
+		var leased BackfillChunk
+		_, err := source.db.QueryOne(&leased, `
+			UPDATE backfill_chunks SET owner = ?, lease_expires = now() + ? * interval '1 second'
+			WHERE (backfill_id, start_height) = (
+				SELECT backfill_id, start_height FROM backfill_chunks
+				WHERE NOT done AND (owner IS NULL OR lease_expires < now())
+				ORDER BY start_height, backfill_id
+				LIMIT 1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING *`, source.owner, LEASE_DURATION.Seconds())
+		if err == nil {
+			if leased.Last_height > leased.Start_height {
+				log.Printf("Taking over chunk [%v, %v) at height %v after its lease expired\n", leased.Start_height, leased.End_height, leased.Last_height)
+			}
+
+			return &chunk{
+				start:    int(leased.Last_height),
+				end:      int(leased.End_height),
+				source:   source,
+				backfill: leased.Backfill_id,
+				id:       leased.Start_height,
+			}, true
+		}
+		if err != pg.ErrNoRows {
+			fatal("Error leasing backfill chunk: ", err)
+		}
+
+		remaining, err := source.db.Model((*BackfillChunk)(nil)).Where("NOT done").Count()
+		if err != nil {
+			fatal("Error counting backfill chunks: ", err)
+		}
+		if remaining == 0 {
+			return nil, false
+		}
+
+		log.Printf("All %v remaining chunks are leased, waiting for leases to expire\n", remaining)
+		select {
+		case <-stopping:
+			return nil, false
+		case <-time.After(LEASE_POLL_INTERVAL):
+		}
+	}
+}
+
+// logProgress records progress and renews the lease on the chunk.
+func (source *pgChunks) logProgress(c *chunk, last int) {
+	res, err := source.db.Exec(`
+		UPDATE backfill_chunks SET last_height = ?, lease_expires = now() + ? * interval '1 second'
+		WHERE backfill_id = ? AND start_height = ? AND owner = ?`, last, LEASE_DURATION.Seconds(), c.backfill, c.id, source.owner)
+	if err != nil {
+		fatal("Error recording backfill progress: ", err)
+	}
+
+	// Someone else took over after our lease expired, both will store the same rows.
+	if res.RowsAffected() == 0 {
+		log.Printf("Lost lease on chunk [%v, %v), consider a longer -lease\n", c.id, c.end)
+	}
+}
+
+func (source *pgChunks) finish(c *chunk) {
+	_, err := source.db.Exec(`
+		UPDATE backfill_chunks SET done = true, last_height = end_height
+		WHERE backfill_id = ? AND start_height = ?`, c.backfill, c.id)
+	if err != nil {
+		fatal("Error finishing backfill chunk: ", err)
+	}
+}
+
+// release gives up the lease, so another process can continue at the recorded progress right away.
+func (source *pgChunks) release(c *chunk) {
+	_, err := source.db.Exec(`
+		UPDATE backfill_chunks SET owner = NULL, lease_expires = NULL
+		WHERE backfill_id = ? AND start_height = ? AND owner = ?`, c.backfill, c.id, source.owner)
+	if err != nil {
+		log.Printf("Error releasing backfill chunk [%v, %v): %v\n", c.id, c.end, err)
+	}
+}
+
+// close does nothing, the connection pool outlives the backfill.
+func (source *pgChunks) close() {}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestBackfillID(t *testing.T) {
+	useBackfillSettings(t)
+
+	id := backfillID(splitRanges([]heightRange{{0, 1000}}))
+	if again := backfillID(splitRanges([]heightRange{{0, 1000}})); again != id {
+		t.Errorf("same range got ids %v and %v", id, again)
+	}
+
+	if other := backfillID(splitRanges([]heightRange{{100, 1000}})); other == id {
+		t.Errorf("different start got the same id %v", id)
+	}
+
+	CHUNK_SIZE = 200
+	if other := backfillID(splitRanges([]heightRange{{0, 1000}})); other == id {
+		t.Errorf("different chunk size got the same id %v", id)
+	}
+}
+
+// usePostgres connects pgPool to the scratch database named by TEST_DB, and skips the test if there is none.
+// The other connection settings are read from the usual environment variables.
+func usePostgres(t *testing.T) {
+	db := os.Getenv("TEST_DB")
+	if db == "" {
+		t.Skip("TEST_DB not set")
+	}
+
+	saved := os.Getenv("DB")
+	os.Setenv("DB", db)
+	t.Cleanup(func() { os.Setenv("DB", saved) })
+
+	pgPool = setupPostgres()
+	t.Cleanup(func() {
+		pgPool.Close()
+		pgPool = nil
+	})
+}
+
+func TestDistributedBackfillRerunFetchesAgain(t *testing.T) {
+	useBackfillSettings(t)
+	resetStopping(t)
+	fake := newFakeBitcoind(t)
+	useMemorySink(t)
+	usePostgres(t)
+	DISTRIBUTED = true
+
+	ranges := []heightRange{{0, 300}}
+	id := backfillID(splitRanges(ranges))
+	clear := func() {
+		_, err := pgPool.Exec(`DELETE FROM backfill_chunks WHERE backfill_id = ?`, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	clear()
+	t.Cleanup(clear)
+
+	fetched := func() map[int64]int {
+		counts := make(map[int64]int)
+		batches, singles := fake.requests()
+		for _, batch := range batches {
+			for _, height := range batch {
+				counts[height]++
+			}
+		}
+		for _, height := range singles {
+			counts[height]++
+		}
+		return counts
+	}
+
+	runBackfill(ranges)
+	runBackfill(ranges)
+
+	counts := fetched()
+	for height := int64(0); height < 300; height++ {
+		if counts[height] != 2 {
+			t.Fatalf("height %v fetched %v times, want 2", height, counts[height])
+		}
+	}
+}
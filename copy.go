@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Batches of at least this many rows are bulk loaded with COPY instead of a multi-row INSERT.
+const COPY_MIN_ROWS = 100
+
+// copyRows bulk loads rows into dashboard_data_v2. The rows are streamed through COPY FROM STDIN
+// into a temporary staging table, one jsonb object per row keyed by column name, and then merged
+// into dashboard_data_v2 with the same conflict handling as upsertRows, and their rollups are updated.
+// Returns the number of rows written.
+func copyRows(db *pg.DB, rows []DashboardDataV2) (int, error) {
+	startTime := time.Now()
+
+	var written int
+	err := db.RunInTransaction(func(tx *pg.Tx) error {
+		_, err := tx.Exec(`CREATE TEMP TABLE dashboard_data_staging (data jsonb NOT NULL) ON COMMIT DROP`)
+		if err != nil {
+			return err
+		}
+
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(writeCopyRows(writer, rows))
+		}()
+
+		_, err = tx.CopyFrom(reader, `COPY dashboard_data_staging (data) FROM STDIN WITH (FORMAT csv)`)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+
+		return updateRollups(tx, rowHeights(rows), func() error {
+			names := make([]string, 0)
+			for _, field := range copyFields() {
+				names = append(names, field.SQLName)
+			}
+			columns := strings.Join(names, ", ")
+			res, err := tx.Exec(`
+				INSERT INTO dashboard_data_v2 (` + columns + `)
+				SELECT ` + columns + ` FROM dashboard_data_staging, jsonb_populate_record(null::dashboard_data_v2, data)
+				` + conflictClause())
+			if err != nil {
+				return err
+			}
+			written = res.RowsAffected()
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	elapsed := time.Since(startTime)
+	log.Printf("Copied %v rows (%v written) in %v, %.0f rows/s\n", len(rows), written, elapsed, float64(len(rows))/elapsed.Seconds())
+
+	return written, nil
+}
+
+// copyFields returns the dashboard_data_v2 fields copyRows stores, all but the id, which every row gets from its sequence.
+func copyFields() []*orm.Field {
+	fields := make([]*orm.Field, 0)
+	for _, field := range orm.GetTable(reflect.TypeOf(DashboardDataV2{})).Fields {
+		if field.SQLName != "id" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// writeCopyRows writes rows as a single CSV column of JSON objects, keyed by column name.
+func writeCopyRows(w io.Writer, rows []DashboardDataV2) error {
+	fields := copyFields()
+
+	csvWriter := csv.NewWriter(w)
+	for _, row := range rows {
+		val := reflect.ValueOf(row)
+
+		object := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			value := val.FieldByName(field.GoName)
+
+			// Array columns are NOT NULL.
+			if value.Kind() == reflect.Slice && value.IsNil() {
+				object[field.SQLName] = []interface{}{}
+				continue
+			}
+			object[field.SQLName] = value.Interface()
+		}
+
+		encoded, err := json.Marshal(object)
+		if err != nil {
+			return err
+		}
+
+		err = csvWriter.Write([]string{string(encoded)})
+		if err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+
+	return csvWriter.Error()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+)
+
+func TestWriteCopyRows(t *testing.T) {
+	rows := []DashboardDataV2{derivedRow(5), {Id: 7, Height: 6, Hash: testHash("6")}}
+
+	var buf bytes.Buffer
+	if err := writeCopyRows(&buf, rows); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(rows) {
+		t.Fatalf("%v records for %v rows", len(records), len(rows))
+	}
+
+	for i, record := range records {
+		if len(record) != 1 {
+			t.Fatalf("record %v has %v columns, want one JSON object", i, len(record))
+		}
+
+		var object map[string]interface{}
+		if err := json.Unmarshal([]byte(record[0]), &object); err != nil {
+			t.Fatal(err)
+		}
+
+		// Every row gets its id from the sequence, a copied 0 would collide.
+		if _, ok := object["id"]; ok {
+			t.Errorf("row %v has an id", i)
+		}
+		if object["height"] != float64(rows[i].Height) || object["hash"] != rows[i].Hash {
+			t.Errorf("row %v holds height %v, hash %v", i, object["height"], object["hash"])
+		}
+		if len(object) != len(copyFields()) {
+			t.Errorf("row %v has %v columns, want %v", i, len(object), len(copyFields()))
+		}
+	}
+
+	// Array columns are NOT NULL, so missing arrays are written empty.
+	var second map[string]interface{}
+	json.Unmarshal([]byte(records[1][0]), &second)
+	if dust, ok := second["dust_output_count"].([]interface{}); !ok || len(dust) != 0 {
+		t.Errorf("dust_output_count of a row without one is %v, want []", second["dust_output_count"])
+	}
+}
+
+func TestCopyRowsFollowsOnConflict(t *testing.T) {
+	checkWriteFollowsOnConflict(t, copyRows)
+}
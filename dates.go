@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// blockHeaderTimes holds the fields of a verbose getblockheader result needed to map dates to heights.
+// btcjson's header result has no mediantime, so the RPC is decoded here.
+type blockHeaderTimes struct {
+	Height     int64 `json:"height"`
+	Time       int64 `json:"time"`
+	MedianTime int64 `json:"mediantime"`
+}
+
+// parseDate accepts a date (2006-01-02, midnight UTC) or an RFC 3339 timestamp.
+func parseDate(date string) time.Time {
+	t, err := time.Parse("2006-01-02", date)
+	if err == nil {
+		return t
+	}
+
+	t, err = time.Parse(time.RFC3339, date)
+	if err != nil {
+		fatal("Error parsing date (expected YYYY-MM-DD or RFC 3339): ", date)
+	}
+
+	return t
+}
+
+// headerTimes returns the header time and median time past of the block at a height in the best chain.
+func (worker *Worker) headerTimes(height int64) blockHeaderTimes {
+	var hash *chainhash.Hash
+	err := retry("getblockhash", func() (err error) {
+		hash, err = worker.client.GetBlockHash(height)
+		return err
+	})
+	if err != nil {
+		fatal("Error with getblockhash RPC: ", err)
+	}
+
+	hashParam, err := json.Marshal(hash.String())
+	if err != nil {
+		fatal("Error encoding block hash: ", err)
+	}
+
+	var rawHeader json.RawMessage
+	err = retry("getblockheader", func() (err error) {
+		rawHeader, err = worker.client.RawRequest("getblockheader", []json.RawMessage{hashParam, json.RawMessage("true")})
+		return err
+	})
+	if err != nil {
+		fatal("Error with getblockheader RPC: ", err)
+	}
+
+	var header blockHeaderTimes
+	err = json.Unmarshal(rawHeader, &header)
+	if err != nil {
+		fatal("Error decoding getblockheader result: ", err)
+	}
+
+	return header
+}
+
+// heightAtTime returns the first height at or after the given time.
+// Header times aren't monotonic, so this binary searches for the first block whose median time past
+// is at or after t, then steps back over directly preceding blocks whose own header time already is.
+// Returns the height after the tip if the chain hasn't reached t yet.
+func (worker *Worker) heightAtTime(t time.Time) int64 {
+	target := t.Unix()
+
+	low, high := int64(0), worker.getBlockCount()+1
+	for low < high {
+		mid := low + (high-low)/2
+		if worker.headerTimes(mid).MedianTime >= target {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+
+	for low > 0 && worker.headerTimes(low-1).Time >= target {
+		low--
+	}
+
+	return low
+}
+
+// resolveDates turns -start-date and -end-date into block heights.
+// Heights are returned unchanged for dates that aren't set.
+func resolveDates(startDate, endDate string, start, end int) (int, int) {
+	worker := setupWorker()
+
+	if startDate != "" {
+		start = int(worker.heightAtTime(parseDate(startDate)))
+		log.Printf("Resolved -start-date=%v to height %v\n", startDate, start)
+	}
+
+	if endDate != "" {
+		end = int(worker.heightAtTime(parseDate(endDate)))
+		log.Printf("Resolved -end-date=%v to height %v\n", endDate, end)
+	}
+
+	return start, end
+}
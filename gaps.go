@@ -0,0 +1,187 @@
+package main
+
+import (
+	"log"
+	"sort"
+
+	"github.com/go-pg/pg"
+)
+
+// heightRange is a half-open interval of block heights [Start, End).
+type heightRange struct {
+	Start int64 `sql:"range_start"`
+	End   int64 `sql:"range_end"`
+}
+
+// mergeRanges sorts the given ranges and merges the ones that overlap or are adjacent.
+func mergeRanges(ranges []heightRange) []heightRange {
+	sorted := make([]heightRange, 0, len(ranges))
+	for _, r := range ranges {
+		if r.Start < r.End {
+			sorted = append(sorted, r)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	merged := make([]heightRange, 0, len(sorted))
+	for _, r := range sorted {
+		last := len(merged) - 1
+		if last >= 0 && r.Start <= merged[last].End {
+			if r.End > merged[last].End {
+				merged[last].End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// withoutHeights removes the given heights, in ascending order, from sorted ranges.
+func withoutHeights(ranges []heightRange, heights []int64) []heightRange {
+	left := make([]heightRange, 0, len(ranges))
+	i := 0
+	for _, r := range ranges {
+		for i < len(heights) && heights[i] < r.Start {
+			i++
+		}
+
+		start := r.Start
+		for ; i < len(heights) && heights[i] < r.End; i++ {
+			if heights[i] > start {
+				left = append(left, heightRange{start, heights[i]})
+			}
+			start = heights[i] + 1
+		}
+		if start < r.End {
+			left = append(left, heightRange{start, r.End})
+		}
+	}
+
+	return left
+}
+
+// findGaps returns the ranges of heights in [floor, ceiling) that are missing from the DashboardDataV2 table
+// (or from the JSON backups if Postgres is not used). Heights waiting in the spool aren't gaps,
+// the replayer stores them once Postgres is back.
+// A negative floor means the lowest height stored so far.
+func (worker *Worker) findGaps(floor, ceiling int64) []heightRange {
+	if !USE_POSTGRES {
+		return findJSONGaps(floor, ceiling)
+	}
+
+	if floor < 0 {
+		_, err := worker.pgClient.QueryOne(pg.Scan(&floor), `SELECT coalesce(min(height), -1) FROM dashboard_data_v2`)
+		if err != nil {
+			fatal("Error finding lowest stored height: ", err)
+		}
+
+		// Nothing stored yet, so there is nothing to fill in.
+		if floor < 0 {
+			return nil
+		}
+	}
+
+	if floor >= ceiling {
+		return nil
+	}
+
+	// Consecutive missing heights share the same (height - row number), which groups them into ranges.
+	var gaps []heightRange
+	_, err := worker.pgClient.Query(&gaps, `
+		SELECT min(h) AS range_start, max(h) + 1 AS range_end
+		FROM (
+			SELECT h, h - row_number() OVER (ORDER BY h) AS grp
+			FROM generate_series(?::bigint, ?::bigint - 1) AS h
+			WHERE NOT EXISTS (SELECT 1 FROM dashboard_data_v2 d WHERE d.height = h)
+		) missing
+		GROUP BY grp
+		ORDER BY range_start`, floor, ceiling)
+	if err != nil {
+		fatal("Error finding missing heights: ", err)
+	}
+
+	return withoutHeights(gaps, spooledHeights())
+}
+
+// findJSONGaps is findGaps for when only JSON backups are kept.
+func findJSONGaps(floor, ceiling int64) []heightRange {
+	heights := storedJSONHeights()
+	if floor < 0 {
+		if len(heights) == 0 {
+			return nil
+		}
+		floor = heights[0]
+	}
+
+	gaps := make([]heightRange, 0)
+	next := floor
+	for _, height := range heights {
+		if height < next {
+			continue
+		}
+		if height >= ceiling {
+			break
+		}
+		if height > next {
+			gaps = append(gaps, heightRange{next, height})
+		}
+		next = height + 1
+	}
+	if next < ceiling {
+		gaps = append(gaps, heightRange{next, ceiling})
+	}
+
+	return gaps
+}
+
+// lastStoredHeight returns the highest height stored so far, or -1 if nothing is stored.
+func (worker *Worker) lastStoredHeight() int64 {
+	if !USE_POSTGRES {
+		heights := storedJSONHeights()
+		if len(heights) == 0 {
+			return -1
+		}
+		return heights[len(heights)-1]
+	}
+
+	var last int64
+	_, err := worker.pgClient.QueryOne(pg.Scan(&last), `SELECT coalesce(max(height), -1) FROM dashboard_data_v2`)
+	if err != nil {
+		fatal("Error finding highest stored height: ", err)
+	}
+
+	return last
+}
+
+// fillGaps finds heights missing from the database in [floor, ceiling)
+// and hands them to the backfill scheduler.
+func (worker *Worker) fillGaps(floor, ceiling int64) {
+	gaps := worker.findGaps(floor, ceiling)
+	if len(gaps) == 0 {
+		log.Printf("No missing heights below %v\n", ceiling)
+		return
+	}
+
+	missing := int64(0)
+	for _, gap := range gaps {
+		log.Printf("Missing heights [%v, %v)\n", gap.Start, gap.End)
+		missing += gap.End - gap.Start
+	}
+	log.Printf("Filling %v missing heights in %v ranges\n", missing, len(gaps))
+
+	runBackfill(gaps)
+
+	log.Println("Finished filling gaps.")
+}
+
+// checkGaps is the standalone gap check, it fills every missing height
+// between GAP_FLOOR and MIN_DIST_FROM_TIP blocks behind the tip.
+func checkGaps() {
+	worker := setupWorker()
+
+	blockCount := worker.getBlockCount()
+
+	worker.fillGaps(GAP_FLOOR, blockCount-MIN_DIST_FROM_TIP+1)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMergeRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []heightRange
+		want   []heightRange
+	}{
+		{"none", nil, []heightRange{}},
+		{"one", []heightRange{{5, 10}}, []heightRange{{5, 10}}},
+		{"apart", []heightRange{{20, 30}, {0, 10}}, []heightRange{{0, 10}, {20, 30}}},
+		{"adjacent", []heightRange{{0, 10}, {10, 20}}, []heightRange{{0, 20}}},
+		{"overlapping", []heightRange{{15, 30}, {0, 20}}, []heightRange{{0, 30}}},
+		{"contained", []heightRange{{0, 30}, {10, 20}}, []heightRange{{0, 30}}},
+		{"empty ranges are dropped", []heightRange{{5, 5}, {10, 8}, {0, 3}}, []heightRange{{0, 3}}},
+		{"chain", []heightRange{{40, 50}, {0, 10}, {5, 20}, {20, 25}, {30, 41}}, []heightRange{{0, 25}, {30, 50}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := mergeRanges(test.ranges); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWithoutHeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		ranges  []heightRange
+		heights []int64
+		want    []heightRange
+	}{
+		{"no heights", []heightRange{{0, 10}}, nil, []heightRange{{0, 10}}},
+		{"outside", []heightRange{{5, 10}}, []int64{2, 10, 11}, []heightRange{{5, 10}}},
+		{"ends", []heightRange{{5, 10}}, []int64{5, 9}, []heightRange{{6, 9}}},
+		{"middle", []heightRange{{0, 10}}, []int64{3, 4, 7}, []heightRange{{0, 3}, {5, 7}, {8, 10}}},
+		{"whole range", []heightRange{{0, 2}, {5, 7}}, []int64{0, 1, 6}, []heightRange{{5, 6}}},
+		{"duplicates", []heightRange{{0, 5}}, []int64{2, 2}, []heightRange{{0, 2}, {3, 5}}},
+		{"several ranges", []heightRange{{0, 5}, {10, 15}}, []int64{4, 7, 10}, []heightRange{{0, 4}, {11, 15}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := withoutHeights(test.ranges, test.heights); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// useJSONBackups points JSON_DIR at a new directory with (empty) backups for the given heights.
+func useJSONBackups(t *testing.T, heights ...int64) {
+	savedJSONDir := JSON_DIR
+	t.Cleanup(func() { JSON_DIR = savedJSONDir })
+	JSON_DIR = t.TempDir()
+
+	for _, height := range heights {
+		err := ioutil.WriteFile(fmt.Sprintf("%v/%v.json", JSON_DIR, height), nil, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFindJSONGaps(t *testing.T) {
+	useJSONBackups(t, 2, 3, 4, 7, 10)
+
+	// Files that aren't backups don't count.
+	for _, name := range []string{"5.json.tmp", "6.json.reason", "notes.json"} {
+		if err := ioutil.WriteFile(JSON_DIR+"/"+name, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(JSON_DIR+"/"+INSERT_JSON_REJECTS_DIR, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		floor, ceiling int64
+		want           []heightRange
+	}{
+		{"from zero", 0, 12, []heightRange{{0, 2}, {5, 7}, {8, 10}, {11, 12}}},
+		{"from the lowest backup", -1, 12, []heightRange{{5, 7}, {8, 10}, {11, 12}}},
+		{"ceiling inside a gap", 0, 6, []heightRange{{0, 2}, {5, 6}}},
+		{"ceiling at a backup", -1, 7, []heightRange{{5, 7}}},
+		{"floor inside a gap", 6, 9, []heightRange{{6, 7}, {8, 9}}},
+		{"no gaps", 2, 5, []heightRange{}},
+		{"empty range", 5, 5, []heightRange{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := findJSONGaps(test.floor, test.ceiling); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("findJSONGaps(%v, %v) = %v, want %v", test.floor, test.ceiling, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFindJSONGapsWithoutBackups(t *testing.T) {
+	useJSONBackups(t)
+
+	if gaps := findJSONGaps(-1, 100); gaps != nil {
+		t.Errorf("got gaps %v without any backups, want none", gaps)
+	}
+	if gaps := findJSONGaps(0, 100); !reflect.DeepEqual(gaps, []heightRange{{0, 100}}) {
+		t.Errorf("got gaps %v, want [0, 100)", gaps)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const MIN_WORKERS_DEFAULT = 1
+const MAX_WORKERS_DEFAULT = 16
+
+// concurrencyLimiter bounds the number of getblockstats requests the backfill workers have in flight,
+// and adjusts that bound based on how bitcoind is coping.
+//
+// After every window of requests, the average latency per block is compared to its long-term average.
+// If requests failed, the limit is cut by a quarter. If latency went up by half, bitcoind is busy
+// and the limit goes down by one. Otherwise there is room for one more request.
+// The long-term average follows slowly, so the limit isn't lowered just because blocks got bigger.
+type concurrencyLimiter struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	limit, working int
+	min, max       int
+
+	// Requests waiting for a slot.
+	waiting int
+
+	// Stats of the current window.
+	requests int
+	errors   int
+	blocks   int
+	latency  time.Duration
+
+	// Long-term average latency per block.
+	avgLatency time.Duration
+}
+
+func newConcurrencyLimiter(initial, min, max int) *concurrencyLimiter {
+	if initial < min {
+		initial = min
+	}
+	if initial > max {
+		initial = max
+	}
+
+	limiter := &concurrencyLimiter{
+		limit: initial,
+		min:   min,
+		max:   max,
+	}
+	limiter.cond = sync.NewCond(&limiter.mu)
+
+	return limiter
+}
+
+// current returns the current number of requests allowed in flight.
+func (limiter *concurrencyLimiter) current() int {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	return limiter.limit
+}
+
+// inFlight returns the number of requests in flight, and the number waiting for a slot.
+func (limiter *concurrencyLimiter) inFlight() (working, waiting int) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	return limiter.working, limiter.waiting
+}
+
+// acquire waits until fewer requests than allowed are in flight, and counts the caller's as one of them.
+func (limiter *concurrencyLimiter) acquire() {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.waiting++
+	for limiter.working >= limiter.limit {
+		limiter.cond.Wait()
+	}
+	limiter.waiting--
+	limiter.working++
+}
+
+// release gives up a slot taken with acquire.
+func (limiter *concurrencyLimiter) release() {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.working--
+	limiter.cond.Broadcast()
+}
+
+// do runs fn, a request for the given number of blocks, once there is a slot for it, and records how it went.
+// The slot is only held while the request is in flight, not while it waits for a retry.
+func (limiter *concurrencyLimiter) do(blocks int, fn func() error) error {
+	limiter.acquire()
+	defer limiter.release()
+
+	start := time.Now()
+	err := fn()
+	latency := time.Since(start)
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.requests++
+	limiter.blocks += blocks
+	limiter.latency += latency
+	if err != nil {
+		limiter.errors++
+	}
+
+	// A window is as many requests as are allowed in flight, but at least a few.
+	if limiter.requests >= limiter.limit && limiter.requests >= 4 {
+		limiter.adjust()
+		// Waiting workers may have room now.
+		limiter.cond.Broadcast()
+	}
+
+	return err
+}
+
+// adjust sets a new limit from the stats of the window that just ended. Assumes mu is held.
+func (limiter *concurrencyLimiter) adjust() {
+	perBlock := limiter.latency
+	if limiter.blocks > 0 {
+		perBlock = limiter.latency / time.Duration(limiter.blocks)
+	}
+	if limiter.avgLatency == 0 {
+		limiter.avgLatency = perBlock
+	}
+
+	previous := limiter.limit
+	switch {
+	case limiter.errors > 0:
+		limiter.limit -= limiter.limit/4 + 1
+	case perBlock > limiter.avgLatency*3/2:
+		limiter.limit--
+	default:
+		limiter.limit++
+	}
+
+	if limiter.limit < limiter.min {
+		limiter.limit = limiter.min
+	}
+	if limiter.limit > limiter.max {
+		limiter.limit = limiter.max
+	}
+
+	if limiter.limit != previous {
+		log.Printf("Concurrent workers %v -> %v (%v per block, average %v, %v errors)\n", previous, limiter.limit, perBlock, limiter.avgLatency, limiter.errors)
+	}
+
+	limiter.avgLatency = (limiter.avgLatency*9 + perBlock) / 10
+	limiter.requests = 0
+	limiter.errors = 0
+	limiter.blocks = 0
+	limiter.latency = 0
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestLimiterHoldsRequestsOverLimit(t *testing.T) {
+	limiter := newConcurrencyLimiter(1, 1, 1)
+
+	firstStarted, firstDone := make(chan struct{}), make(chan struct{})
+	go limiter.do(1, func() error {
+		close(firstStarted)
+		<-firstDone
+		return nil
+	})
+	<-firstStarted
+
+	secondStarted := make(chan struct{})
+	go limiter.do(1, func() error {
+		close(secondStarted)
+		return nil
+	})
+
+	// Wait until the second request waits for a slot, or was sent without one.
+	for {
+		select {
+		case <-secondStarted:
+			t.Fatal("second request sent while the only slot was taken")
+		default:
+		}
+		if _, waiting := limiter.inFlight(); waiting == 1 {
+			break
+		}
+		runtime.Gosched()
+	}
+	if working, _ := limiter.inFlight(); working != 1 {
+		t.Errorf("%v requests in flight, want 1", working)
+	}
+
+	close(firstDone)
+	select {
+	case <-secondStarted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("second request not sent after the first finished")
+	}
+}
+
+func TestLimiterAdjusts(t *testing.T) {
+	limiter := newConcurrencyLimiter(4, 1, 8)
+	ok := func() error { return nil }
+	failed := func() error { return errors.New("503 Service Unavailable") }
+
+	// A window of four requests without errors makes room for one more.
+	for i := 0; i < 4; i++ {
+		limiter.do(1, ok)
+	}
+	if limit := limiter.current(); limit != 5 {
+		t.Errorf("limit after a good window = %v, want 5", limit)
+	}
+
+	// Any error cuts it by a quarter.
+	for i := 0; i < 5; i++ {
+		limiter.do(1, failed)
+	}
+	if limit := limiter.current(); limit != 3 {
+		t.Errorf("limit after a window with errors = %v, want 3", limit)
+	}
+
+	if working, waiting := limiter.inFlight(); working != 0 || waiting != 0 {
+		t.Errorf("%v in flight and %v waiting after all requests returned", working, waiting)
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"github.com/btcsuite/btcd/rpcclient"
 
 	"github.com/go-pg/pg"
-	"github.com/go-pg/pg/orm"
 )
 
 /*
@@ -118,9 +117,9 @@ func max(x, y float64) float64 {
 	return y
 }
 
+// MempoolDataWorker makes the RPC calls of the mempool analysis, its data goes to the sinks.
 type MempoolDataWorker struct {
-	client   *rpcclient.Client
-	pgClient *pg.DB
+	client *rpcclient.Client
 }
 
 func newMempoolData() MempoolData {
@@ -144,7 +143,6 @@ func liveMempoolAnalysis() {
 	//	return
 
 	worker := setupMempoolAnalysis()
-	defer worker.shutdown()
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -159,12 +157,20 @@ func liveMempoolAnalysis() {
 			log.Println("Logging mempool state at time: ", t)
 			currentTime := time.Now()
 
-			rawMempool, err := worker.client.GetRawMempoolVerbose()
+			var rawMempool map[string]btcjson.GetRawMempoolVerboseResult
+			err := retry("getrawmempool", func() (err error) {
+				rawMempool, err = worker.client.GetRawMempoolVerbose()
+				return err
+			})
 			if err != nil {
 				fatal(err)
 			}
 
-			mpInfo, err := worker.client.GetMempoolInfo()
+			var mpInfo *btcjson.GetMempoolInfoResult
+			err = retry("getmempoolinfo", func() (err error) {
+				mpInfo, err = worker.client.GetMempoolInfo()
+				return err
+			})
 			if err != nil {
 				fatal(err)
 			}
@@ -175,10 +181,7 @@ func liveMempoolAnalysis() {
 
 			mempoolData = nextData
 
-			err = worker.pgClient.Insert(&mempoolData)
-			if err != nil {
-				fatal("PG database insert failed! ", err)
-			}
+			writeMempool(mempoolData)
 
 		case <-sigs:
 			log.Println("Shutting down mempool analysis.")
@@ -188,51 +191,9 @@ func liveMempoolAnalysis() {
 }
 
 func setupMempoolAnalysis() MempoolDataWorker {
-	BITCOIND_HOST, ok := os.LookupEnv("BITCOIND_HOST")
-	if !ok {
-		BITCOIND_HOST = "localhost:8332"
-	}
-
-	// Connect to local bitcoin core RPC server using HTTP POST mode.
-	connCfg := &rpcclient.ConnConfig{
-		Host: BITCOIND_HOST,
-		User: os.Getenv("BITCOIND_USERNAME"),
-		Pass: os.Getenv("BITCOIND_PASSWORD"),
-
-		HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
-		DisableTLS:   true, // Bitcoin core does not provide TLS by default
-	}
-	// Notice the notification parameter is nil since notifications are
-	// not supported in HTTP POST mode.
-	client, err := rpcclient.New(connCfg, nil)
-	if err != nil {
-		fatal(err)
-	}
-
-	DB_ADDR, ok := os.LookupEnv("DB_ADDR")
-	if !ok {
-		DB_ADDR = "localhost:5432"
-	}
-
-	db := pg.Connect(&pg.Options{
-		Addr:     DB_ADDR,
-		User:     os.Getenv("DB_USERNAME"),
-		Password: os.Getenv("DB_PASSWORD"),
-		Database: os.Getenv("DB"),
-	})
-
-	model := interface{}((*MempoolData)(nil))
-	err = db.CreateTable(model, &orm.CreateTableOptions{
-		Temp:        false,
-		IfNotExists: true,
-	})
-	if err != nil {
-		fatal(err)
-	}
-
 	// Prints out the queries created by go-pg.
-	if SHOW_QUERIES_MEMPOOL {
-		db.OnQueryProcessed(func(event *pg.QueryProcessedEvent) {
+	if SHOW_QUERIES_MEMPOOL && pgPool != nil {
+		pgPool.OnQueryProcessed(func(event *pg.QueryProcessedEvent) {
 			query, err := event.FormattedQuery()
 			if err != nil {
 				fatal(err)
@@ -243,14 +204,8 @@ func setupMempoolAnalysis() MempoolDataWorker {
 	}
 
 	worker := MempoolDataWorker{
-		client:   client,
-		pgClient: db,
+		client: nextRPCClient(),
 	}
 
 	return worker
 }
-
-func (worker *MempoolDataWorker) shutdown() {
-	worker.client.Shutdown()
-	worker.pgClient.Close()
-}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Any number taken by nothing else, for the advisory lock held while migrating,
+// so that processes starting at the same time don't apply a migration twice.
+const MIGRATION_LOCK_ID = 73126
+
+// SchemaMigration records a migration that was applied to the database.
+type SchemaMigration struct {
+	tableName struct{} `sql:"schema_migrations"`
+
+	Version     int `sql:",pk"`
+	Description string
+	Applied_at  time.Time `sql:"default:now()"`
+}
+
+// pgExecer is the part of *pg.Tx that migrations and rollups need, so tests can record the queries.
+type pgExecer interface {
+	Exec(query interface{}, params ...interface{}) (orm.Result, error)
+	Query(model, query interface{}, params ...interface{}) (orm.Result, error)
+}
+
+// A migration takes the schema from version-1 to version.
+type migration struct {
+	version     int
+	description string
+	up          func(tx pgExecer) error
+}
+
+// migrations are applied in order, each one exactly once. Never change or remove a migration that was released,
+// add a new one at the end instead. Tables are created with plain SQL rather than from the Go structs, so a migration
+// does the same thing whenever it runs, and a new struct field needs a migration for its column.
+// testdata/migrations.sql records the statements, see TestMigrationsMatchRecording.
+//
+// Databases from before migrations had their tables created from the Go structs of the time, so later migrations
+// may run against tables that already have their changes, and must not fail if so (e.g. ADD COLUMN IF NOT EXISTS).
+var migrations = []migration{
+	{1, "create dashboard_data_v2, stale_blocks and mempool_data", func(tx pgExecer) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS dashboard_data_v2 (
+				id bigserial NOT NULL,
+				avg_fee bigint NOT NULL,
+				avg_fee_rate bigint NOT NULL,
+				avg_tx_size bigint NOT NULL,
+				hash text NOT NULL,
+				height bigint NOT NULL,
+				num_inputs bigint NOT NULL,
+				max_fee bigint NOT NULL,
+				max_fee_rate bigint NOT NULL,
+				max_tx_size bigint NOT NULL,
+				median_fee bigint NOT NULL,
+				median_time bigint,
+				median_tx_size bigint NOT NULL,
+				min_fee bigint NOT NULL,
+				min_fee_rate bigint NOT NULL,
+				min_tx_size bigint NOT NULL,
+				feerate_percentiles bigint[] NOT NULL,
+				num_outputs bigint NOT NULL,
+				subsidy bigint NOT NULL,
+				segwit_total_size bigint NOT NULL,
+				segwit_total_weight bigint NOT NULL,
+				num_segwit_txs bigint NOT NULL,
+				time bigint NOT NULL,
+				total_amount_out bigint NOT NULL,
+				total_block_size bigint NOT NULL,
+				total_weight bigint NOT NULL,
+				total_fee bigint NOT NULL,
+				num_txs bigint NOT NULL,
+				utxo_increase bigint NOT NULL,
+				utxo_size_increase bigint NOT NULL,
+				nested_p2wpkh_outputs_spent bigint NOT NULL,
+				nested_p2wsh_outputs_spent bigint NOT NULL,
+				native_p2wpkh_outputs_spent bigint NOT NULL,
+				native_p2wsh_outputs_spent bigint NOT NULL,
+				txs_spending_nested_p2wpkh_outputs bigint NOT NULL,
+				txs_spending_nested_p2wsh_outputs bigint NOT NULL,
+				txs_spending_native_p2wpkh_outputs bigint NOT NULL,
+				txs_spending_native_p2wsh_outputs bigint NOT NULL,
+				value_of_nested_p2wpkh_outputs_spent bigint NOT NULL,
+				value_of_nested_p2wsh_outputs_spent bigint NOT NULL,
+				value_of_native_p2wpkh_outputs_spent bigint NOT NULL,
+				value_of_native_p2wsh_outputs_spent bigint NOT NULL,
+				value_of_native_p2wpkh_outputs_created bigint NOT NULL,
+				value_of_native_p2wsh_outputs_created bigint NOT NULL,
+				new_p2wpkh_outputs bigint NOT NULL,
+				new_p2wsh_outputs bigint NOT NULL,
+				txs_creating_p2wpkh bigint NOT NULL,
+				txs_creating_p2wsh bigint NOT NULL,
+				txs_signalling_opt_in_rbf bigint NOT NULL,
+				consolidating_txs bigint NOT NULL,
+				outputs_consolidated bigint NOT NULL,
+				batching_txs bigint NOT NULL,
+				txs_by_output_count bigint[] NOT NULL,
+				dust_output_count bigint[] NOT NULL,
+				mto_consolidations bigint NOT NULL,
+				mto_output_count bigint NOT NULL,
+				mto_total_value bigint NOT NULL,
+				num_txs_creating_native_segwit_outputs bigint NOT NULL,
+				txs_spending_native_sw_outputs bigint NOT NULL,
+				txs_spending_nested_sw_outputs bigint NOT NULL,
+				percent_inputs_consolidated double precision NOT NULL,
+				percent_new_outs_p2wpkh_outputs double precision NOT NULL,
+				percent_new_outs_p2wsh_outputs double precision NOT NULL,
+				percent_txs_by_output_count double precision[] NOT NULL,
+				dust_output_percentages double precision[] NOT NULL,
+				percent_of_inputs_spending_p2wpkh_outputs double precision NOT NULL,
+				percent_of_inputs_spending_p2wsh_outputs double precision NOT NULL,
+				percent_of_inputs_spending_native_p2wpkh_outputs double precision NOT NULL,
+				percent_of_inputs_spending_native_p2wsh_outputs double precision NOT NULL,
+				percent_of_inputs_spending_native_sw_outputs double precision NOT NULL,
+				percent_of_inputs_spending_nested_sw_outputs double precision NOT NULL,
+				percent_of_inputs_spending_nested_p2wpkh_output double precision NOT NULL,
+				percent_of_inputs_spending_nested_p2wsh_outputs double precision NOT NULL,
+				percent_txs_spending_p2wpkh_outputs double precision NOT NULL,
+				percent_txs_spending_p2wsh_outputs double precision NOT NULL,
+				percent_txs_spending_native_p2wpkh_outputs double precision NOT NULL,
+				percent_txs_spending_native_p2wsh_outputs double precision NOT NULL,
+				percent_txs_spending_native_segwit_outputs double precision NOT NULL,
+				percent_txs_spending_nested_segwit_outputs double precision NOT NULL,
+				percent_txs_spending_nested_p2wpkh_outputs double precision NOT NULL,
+				percent_txs_spending_nested_p2wsh_outputs double precision NOT NULL,
+				percent_txs_creating_p2wpkh_outputs double precision NOT NULL,
+				percent_txs_creating_p2wsh_outputs double precision NOT NULL,
+				percent_txs_creating_native_segwit_outputs double precision NOT NULL,
+				percent_sw_txs_that_are_native_sw double precision NOT NULL,
+				percent_txs_that_are_segwit_txs double precision NOT NULL,
+				percent_txs_signalling_opt_in_rbf double precision NOT NULL,
+				percent_txs_consolidating double precision NOT NULL,
+				percent_txs_batching double precision NOT NULL,
+				PRIMARY KEY (id)
+			)`, `
+			CREATE TABLE IF NOT EXISTS stale_blocks (
+				hash text NOT NULL,
+				height bigint NOT NULL,
+				replaced_by_height bigint NOT NULL,
+				replaced_by_hash text NOT NULL,
+				detected_at bigint NOT NULL,
+				dashboard_data_row jsonb NOT NULL,
+				PRIMARY KEY (hash)
+			)`, `
+			CREATE TABLE IF NOT EXISTS mempool_data (
+				time bigint NOT NULL,
+				size bigint NOT NULL,
+				bytes bigint NOT NULL,
+				mempool_min_fee double precision NOT NULL,
+				size_diff bigint NOT NULL,
+				bytes_diff bigint NOT NULL,
+				mempool_min_fee_diff double precision NOT NULL,
+				size_per_fee_bucket bigint[] NOT NULL,
+				bytes_per_fee_bucket bigint[] NOT NULL,
+				total_fee_per_fee_bucket double precision[] NOT NULL,
+				size_per_fee_bucket_diff bigint[] NOT NULL,
+				bytes_per_fee_bucket_diff bigint[] NOT NULL,
+				total_fee_per_fee_bucket_diff double precision[] NOT NULL
+			)`)
+	}},
+	{2, "add version to dashboard_data_v2", func(tx pgExecer) error {
+		// Tables created before rows were versioned only hold version 2 rows.
+		_, err := tx.Exec("ALTER TABLE dashboard_data_v2 ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 2")
+		return err
+	}},
+	{3, "unique index on dashboard_data_v2 height", func(tx pgExecer) error {
+		// Conflicting inserts are resolved on the height, see upsertRows.
+		_, err := tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS dashboard_data_v2_height_key ON dashboard_data_v2 (height)")
+		return err
+	}},
+	{4, "create backfill_chunks", func(tx pgExecer) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS backfill_chunks (
+				start_height bigint NOT NULL,
+				end_height bigint NOT NULL,
+				last_height bigint NOT NULL,
+				owner text,
+				lease_expires timestamptz,
+				done boolean NOT NULL,
+				PRIMARY KEY (start_height)
+			)`)
+	}},
+	{5, "create and fill rollup tables", func(tx pgExecer) error {
+		// Time buckets are refreshed by a range of block times.
+		_, err := tx.Exec("CREATE INDEX IF NOT EXISTS dashboard_data_v2_time_idx ON dashboard_data_v2 (time)")
+		if err != nil {
+			return err
+		}
+
+		for _, p := range rollupPeriods {
+			err := p.createTable(tx)
+			if err == nil {
+				err = p.rebuild(tx)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{6, "add backfill_id to the backfill_chunks primary key", func(tx pgExecer) error {
+		// Chunks queued before keep an empty id, and are finished like any other.
+		_, err := tx.Exec(`
+			ALTER TABLE backfill_chunks ADD COLUMN IF NOT EXISTS backfill_id text NOT NULL DEFAULT '',
+			DROP CONSTRAINT IF EXISTS backfill_chunks_pkey,
+			ADD PRIMARY KEY (backfill_id, start_height)`)
+		return err
+	}},
+}
+
+// execAll runs the statements in order, and stops at the first that fails.
+func execAll(tx pgExecer, statements ...string) error {
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaVersion returns the version of the last migration applied to the database, 0 if none.
+func schemaVersion(db *pg.DB) int {
+	var version int
+	_, err := db.QueryOne(pg.Scan(&version), `SELECT coalesce(max(version), 0) FROM schema_migrations`)
+	if err != nil {
+		fatal("Error reading schema version: ", err)
+	}
+
+	return version
+}
+
+// migratePostgres applies all migrations that haven't been applied to the database yet.
+// Each migration runs in its own transaction together with its record in schema_migrations.
+func migratePostgres(db *pg.DB) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint NOT NULL,
+			description text,
+			applied_at timestamptz DEFAULT now(),
+			PRIMARY KEY (version)
+		)`)
+	if err != nil {
+		fatal("Error creating schema_migrations table: ", err)
+	}
+
+	current := schemaVersion(db)
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		fatal(fmt.Sprintf("Database schema version %v is newer than this program knows (%v)", current, latest))
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		err := db.RunInTransaction(func(tx *pg.Tx) error {
+			_, err := tx.Exec(`SELECT pg_advisory_xact_lock(?)`, MIGRATION_LOCK_ID)
+			if err != nil {
+				return err
+			}
+
+			// Another process may have applied it while we waited for the lock.
+			applied, err := tx.Model((*SchemaMigration)(nil)).Where("version = ?", m.version).Count()
+			if err != nil || applied > 0 {
+				return err
+			}
+
+			err = m.up(tx)
+			if err != nil {
+				return err
+			}
+
+			return tx.Insert(&SchemaMigration{Version: m.version, Description: m.description})
+		})
+		if err != nil {
+			fatal(fmt.Sprintf("Error applying migration %v (%v): ", m.version, m.description), err)
+		}
+		log.Printf("Applied migration %v: %v\n", m.version, m.description)
+	}
+}
+
+// dataUpgrades turn a JSON backup of one Data version into the next version, by the version they start from.
+var dataUpgrades = map[int64]func(data *Data){
+	// Fixes and fills in derived columns, see computeDerived.
+	2: func(data *Data) {
+		data.DashboardDataRow.computeDerived()
+	},
+}
+
+// upgradeData brings a JSON backup up to CURRENT_VERSION_NUMBER, one version at a time.
+func upgradeData(data *Data) error {
+	for data.Version < CURRENT_VERSION_NUMBER {
+		upgrade, ok := dataUpgrades[data.Version]
+		if !ok {
+			return fmt.Errorf("no upgrade from version %v", data.Version)
+		}
+
+		upgrade(data)
+		data.Version++
+	}
+	data.DashboardDataRow.Version = data.Version
+
+	return nil
+}
+
+// migrateJSON upgrades all JSON backups written by older versions.
+func migrateJSON() {
+	upgraded, failed := 0, 0
+	for _, height := range storedJSONHeights() {
+		data, ok := readDataFile(height)
+		if !ok || data.Version >= CURRENT_VERSION_NUMBER {
+			continue
+		}
+
+		from := data.Version
+		err := upgradeData(&data)
+		if err != nil {
+			log.Printf("Error upgrading JSON backup at height %v from version %v: %v\n", height, from, err)
+			failed++
+			continue
+		}
+
+		storeDataAsFile(data)
+		upgraded++
+	}
+
+	log.Printf("Upgraded %v JSON backups to version %v, %v failed\n", upgraded, CURRENT_VERSION_NUMBER, failed)
+}
+
+// migrate is the -migrate command. Postgres migrations are also applied at every startup,
+// JSON backups are only upgraded here.
+func migrate() {
+	if USE_POSTGRES {
+		log.Printf("Database schema is at version %v\n", schemaVersion(pgPool))
+	}
+
+	if BACKUP_JSON {
+		migrateJSON()
+	}
+}
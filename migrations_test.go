@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+var updateRecordings = flag.Bool("update", false, "rewrite the recordings in testdata")
+
+// statementTx is a pgExecer that records every statement, indented the same way whatever the Go code looks like.
+type statementTx struct {
+	statements []string
+}
+
+func (tx *statementTx) record(query interface{}, params []interface{}) {
+	lines := strings.Split(strings.TrimSpace(fmt.Sprint(query)), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+		if i > 0 && !strings.HasPrefix(lines[i], ")") {
+			lines[i] = "  " + lines[i]
+		}
+	}
+
+	statement := strings.Join(lines, "\n")
+	if len(params) > 0 {
+		statement += fmt.Sprintf(" -- %v", params)
+	}
+	tx.statements = append(tx.statements, statement)
+}
+
+func (tx *statementTx) Exec(query interface{}, params ...interface{}) (orm.Result, error) {
+	tx.record(query, params)
+	return nil, nil
+}
+
+func (tx *statementTx) Query(model, query interface{}, params ...interface{}) (orm.Result, error) {
+	tx.record(query, params)
+	return nil, nil
+}
+
+// TestMigrationsMatchRecording applies the migrations in order and compares their statements
+// to testdata/migrations.sql, so a released migration can't change by accident.
+// Run with -update after adding a migration.
+func TestMigrationsMatchRecording(t *testing.T) {
+	var recorded strings.Builder
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Fatalf("migration %v is number %v in the list", m.version, i+1)
+		}
+
+		tx := &statementTx{}
+		err := m.up(tx)
+		if err != nil {
+			t.Fatalf("migration %v: %v", m.version, err)
+		}
+
+		fmt.Fprintf(&recorded, "-- %v: %v\n", m.version, m.description)
+		for _, statement := range tx.statements {
+			fmt.Fprintf(&recorded, "%v;\n", statement)
+		}
+		recorded.WriteString("\n")
+	}
+
+	path := "testdata/migrations.sql"
+	if *updateRecordings {
+		err := ioutil.WriteFile(path, []byte(recorded.String()), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Split(recorded.String(), "\n")
+	wanted := strings.Split(string(want), "\n")
+	for i := 0; i < len(got) || i < len(wanted); i++ {
+		var g, w string
+		if i < len(got) {
+			g = got[i]
+		}
+		if i < len(wanted) {
+			w = wanted[i]
+		}
+		if g != w {
+			t.Fatalf("%v:%v differs from the migrations:\n got: %v\nwant: %v\nAdd a migration instead of changing a released one, then run with -update.", path, i+1, g, w)
+		}
+	}
+}
+
+// TestMigratedSchemaHasStructColumns checks that the migrations create a column for every field the code writes.
+func TestMigratedSchemaHasStructColumns(t *testing.T) {
+	usePostgres(t)
+
+	tables := map[string]interface{}{
+		"dashboard_data_v2": DashboardDataV2{},
+		"stale_blocks":      StaleBlock{},
+		"mempool_data":      MempoolData{},
+		"backfill_chunks":   BackfillChunk{},
+		"schema_migrations": SchemaMigration{},
+	}
+
+	for table, model := range tables {
+		var columns pg.Strings
+		_, err := pgPool.Query(&columns, `SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ?`, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exists := make(map[string]bool)
+		for _, column := range columns {
+			exists[column] = true
+		}
+
+		for _, field := range orm.GetTable(reflect.TypeOf(model)).Fields {
+			if !exists[field.SQLName] {
+				t.Errorf("%v has no column %v for %v", table, field.SQLName, field.GoName)
+			}
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Batches each queue between stages holds per backfill worker.
+const PIPELINE_QUEUE_DEPTH = 2
+
+// A fetchedBatch holds the getblockstats results for heights [start, end) of a chunk.
+// If stopped is set, the chunk was given up at start on shutdown and the batch holds no results.
+type fetchedBatch struct {
+	c          *chunk
+	start, end int
+	stats      []BlockStats
+	stopped    bool
+}
+
+// A transformedBatch is a fetchedBatch turned into rows.
+type transformedBatch struct {
+	c          *chunk
+	start, end int
+	rows       []DashboardDataV2
+	stopped    bool
+}
+
+// A pipeline runs a backfill in three stages connected by bounded queues:
+// up to MAX_WORKERS fetchers call getblockstats, one transformer builds the rows, and one writer
+// stores them in batches and records the progress of each chunk after every commit.
+// A slow database fills up the queues and holds back the fetchers, but never stalls an RPC in flight.
+type pipeline struct {
+	source  chunkSource
+	limiter *concurrencyLimiter
+
+	fetched     chan fetchedBatch
+	transformed chan transformedBatch
+
+	startTime  time.Time
+	chunksDone int64
+}
+
+func newPipeline(source chunkSource, limiter *concurrencyLimiter) *pipeline {
+	return &pipeline{
+		source:      source,
+		limiter:     limiter,
+		fetched:     make(chan fetchedBatch, PIPELINE_QUEUE_DEPTH*MAX_WORKERS),
+		transformed: make(chan transformedBatch, PIPELINE_QUEUE_DEPTH*MAX_WORKERS),
+	}
+}
+
+// run starts all stages and returns once every chunk is stored, or given up on shutdown.
+func (p *pipeline) run() {
+	p.startTime = time.Now()
+
+	var fetchers sync.WaitGroup
+	fetchers.Add(MAX_WORKERS)
+	for i := 0; i < MAX_WORKERS; i++ {
+		go func(workerID int) {
+			defer fetchers.Done()
+			p.fetch(workerID)
+		}(i)
+	}
+	go func() {
+		fetchers.Wait()
+		close(p.fetched)
+	}()
+
+	go p.transform()
+
+	p.write()
+}
+
+// queueDepths returns the number of batches waiting in front of the transformer and the writer.
+func (p *pipeline) queueDepths() (fetched, transformed int) {
+	return len(p.fetched), len(p.transformed)
+}
+
+// fetch takes chunks from the source and fetches their blocks RPC_BATCH_SIZE at a time.
+// Each request waits for a slot in the limiter, see Worker.limited.
+func (p *pipeline) fetch(workerID int) {
+	worker := setupWorker()
+	worker.limiter = p.limiter
+
+	batchSize := RPC_BATCH_SIZE
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	for {
+		if !p.fetchChunk(&worker, workerID, batchSize) {
+			return
+		}
+	}
+}
+
+// fetchChunk takes the next chunk and fetches it.
+// Returns false once there are no chunks left, or on shutdown.
+func (p *pipeline) fetchChunk(worker *Worker, workerID int, batchSize int) bool {
+	if stopRequested() {
+		return false
+	}
+
+	c, ok := p.source.next()
+	if !ok {
+		return false
+	}
+	c.worker = workerID
+
+	// A chunk taken over right before it was marked done has nothing left to fetch.
+	if c.start >= c.end {
+		p.fetched <- fetchedBatch{c: c, start: c.start, end: c.end}
+		return true
+	}
+
+	for i := c.start; i < c.end; i += batchSize {
+		if stopRequested() {
+			p.fetched <- fetchedBatch{c: c, start: i, end: i, stopped: true}
+			return false
+		}
+
+		batchEnd := i + batchSize
+		if batchEnd > c.end {
+			batchEnd = c.end
+		}
+
+		startBatch := time.Now()
+		stats := worker.getBlockStatsRange(int64(i), int64(batchEnd))
+		log.Printf("Worker %v: Fetched %v blocks of chunk (height=%v) after %v (workers=%v)\n", workerID, batchEnd-c.start, batchEnd-1, time.Since(startBatch), p.limiter.current())
+
+		p.fetched <- fetchedBatch{c: c, start: i, end: batchEnd, stats: stats}
+	}
+
+	return true
+}
+
+// transform builds rows from fetched batches.
+// There is only one transformer, so the batches of a chunk reach the writer in order.
+func (p *pipeline) transform() {
+	for batch := range p.fetched {
+		rows := make([]DashboardDataV2, len(batch.stats))
+		for i, stats := range batch.stats {
+			rows[i] = stats.transformToDashboardData()
+		}
+
+		p.transformed <- transformedBatch{
+			c:       batch.c,
+			start:   batch.start,
+			end:     batch.end,
+			rows:    rows,
+			stopped: batch.stopped,
+		}
+	}
+	close(p.transformed)
+}
+
+// write stores rows in batches. A batch is committed whenever a chunk is complete, or when the
+// last commit was DB_WAIT_TIME seconds ago, which keeps us from overwhelming the database.
+func (p *pipeline) write() {
+	worker := setupWorker()
+
+	// The height up to which each chunk with rows in the current batch will be stored after the commit.
+	pending := make(map[*chunk]int)
+	// Chunks given up on shutdown, released after the commit.
+	stopped := make([]*chunk, 0)
+	blocks := 0
+
+	commit := func() {
+		if !worker.commitBatchInsert() {
+			fatal("DB write failed!")
+		}
+
+		for c, last := range pending {
+			// Record progress, overwriting previous record.
+			c.logProgress(last)
+
+			if last == c.end {
+				c.finish()
+				done := atomic.AddInt64(&p.chunksDone, 1)
+				log.Printf("Worker %v: Done with chunk [%v, %v), %v chunks after %v\n", c.worker, c.start, c.end, done, time.Since(p.startTime))
+			}
+		}
+		for _, c := range stopped {
+			c.release()
+			log.Printf("Worker %v: Stopped chunk [%v, %v) early at height %v\n", c.worker, c.start, c.end, pending[c])
+		}
+
+		fetched, transformed := p.queueDepths()
+		working, waiting := p.limiter.inFlight()
+		log.Printf("Stored %v blocks after %v (queued batches: %v fetched, %v transformed) (workers=%v, requests: %v in flight, %v waiting)\n",
+			blocks, time.Since(p.startTime), fetched, transformed, p.limiter.current(), working, waiting)
+
+		pending = make(map[*chunk]int)
+		stopped = stopped[:0]
+	}
+
+	ticker := time.NewTicker(DB_WAIT_TIME * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case batch, ok := <-p.transformed:
+			if !ok {
+				if len(pending) > 0 {
+					commit()
+				}
+				return
+			}
+
+			pending[batch.c] = batch.end
+			if batch.stopped {
+				stopped = append(stopped, batch.c)
+				continue
+			}
+
+			for _, row := range batch.rows {
+				worker.batchInsert(row)
+			}
+			blocks += len(batch.rows)
+
+			if batch.end == batch.c.end {
+				commit()
+			}
+		case <-ticker.C:
+			if len(pending) > 0 {
+				commit()
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingChunks is a chunkSource that counts the chunks taken from it, and closes all once it handed out that many.
+type countingChunks struct {
+	chunkSource
+	taken int64
+
+	want int64
+	all  chan struct{}
+}
+
+func (source *countingChunks) next() (*chunk, bool) {
+	c, ok := source.chunkSource.next()
+	if ok {
+		if atomic.AddInt64(&source.taken, 1) == source.want {
+			close(source.all)
+		}
+		// Progress is recorded through the chunk's own source.
+		c.source = source
+	}
+	return c, ok
+}
+
+func TestPipelineTakesChunksWithoutSlots(t *testing.T) {
+	useBackfillSettings(t)
+	resetStopping(t)
+	fake := newFakeBitcoind(t)
+	stored := useMemorySink(t)
+	N_WORKERS, MIN_WORKERS, MAX_WORKERS = 1, 1, 4
+
+	source := &countingChunks{
+		chunkSource: newLocalChunks([]heightRange{{0, 400}}),
+		want:        4,
+		all:         make(chan struct{}),
+	}
+
+	// Hold up the first request, which takes the only slot, until every fetcher took a chunk.
+	var once sync.Once
+	fake.status = func(batch bool, heights []int64) int {
+		once.Do(func() {
+			select {
+			case <-source.all:
+			case <-time.After(10 * time.Second):
+				t.Errorf("%v of 4 chunks taken while a request was in flight", atomic.LoadInt64(&source.taken))
+			}
+		})
+		return 200
+	}
+
+	done := make(chan struct{})
+	go func() {
+		backfillChunks(source)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("backfill didn't finish")
+	}
+
+	for height := int64(0); height < 400; height++ {
+		if !stored.has(height) {
+			t.Errorf("height %v wasn't stored", height)
+		}
+	}
+}
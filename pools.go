@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/go-pg/pg"
+)
+
+const RPC_POOL_SIZE_DEFAULT = 16
+const DB_POOL_SIZE_DEFAULT = 20
+
+// Connections shared by every worker in the process, set up once by setupPools.
+var rpcPool []*rpcclient.Client
+var rpcPoolNext uint32
+var batchClientPool *batchRPCClient
+var pgPool *pg.DB
+
+// setupPools connects to bitcoind and Postgres, and sets up the schema.
+// Assumes enviroment variables: DB, DB_USERNAME, DB_PASSWORD, BITCOIND_HOST, BITCOIND_USERNAME, BITCOIND_PASSWORD, are all set.
+// PostgreSQL and bitcoind should already be started.
+func setupPools() {
+	if RPC_POOL_SIZE < 1 {
+		RPC_POOL_SIZE = 1
+	}
+
+	rpcPool = make([]*rpcclient.Client, RPC_POOL_SIZE)
+	for i := range rpcPool {
+		rpcPool[i] = newRPCClient()
+	}
+	batchClientPool = newBatchRPCClient()
+
+	if USE_POSTGRES {
+		pgPool = setupPostgres()
+	}
+}
+
+// closePools closes all shared connections.
+func closePools() {
+	for _, client := range rpcPool {
+		client.Shutdown()
+	}
+	if pgPool != nil {
+		pgPool.Close()
+	}
+}
+
+// newRPCClient connects to bitcoind's RPC server.
+func newRPCClient() *rpcclient.Client {
+	BITCOIND_HOST, ok := os.LookupEnv("BITCOIND_HOST")
+	if !ok {
+		BITCOIND_HOST = "localhost:8332"
+	}
+
+	// Connect to local bitcoin core RPC server using HTTP POST mode.
+	connCfg := &rpcclient.ConnConfig{
+		Host: BITCOIND_HOST,
+		User: os.Getenv("BITCOIND_USERNAME"),
+		Pass: os.Getenv("BITCOIND_PASSWORD"),
+
+		HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
+		DisableTLS:   true, // Bitcoin core does not provide TLS by default
+	}
+	// Notice the notification parameter is nil since notifications are
+	// not supported in HTTP POST mode.
+	client, err := rpcclient.New(connCfg, nil)
+	if err != nil {
+		fatal("Error connecting to bitcoin rpcclient", err)
+	}
+
+	return client
+}
+
+// nextRPCClient hands out the pooled RPC clients round-robin.
+// rpcclient sends one request at a time in HTTP POST mode, so the pool size is
+// the number of single RPC calls that can be in flight at once.
+func nextRPCClient() *rpcclient.Client {
+	i := atomic.AddUint32(&rpcPoolNext, 1)
+	return rpcPool[int(i)%len(rpcPool)]
+}
+
+// setupPostgres connects to PostgreSQL with a pool of DB_POOL_SIZE connections,
+// and brings the schema up to date, see migrations.
+// Assumes enviroment variables: DB, DB_USERNAME, DB_PASSWORD are set.
+func setupPostgres() *pg.DB {
+	DB_ADDR, ok := os.LookupEnv("DB_ADDR")
+	if !ok {
+		DB_ADDR = "localhost:5432"
+	}
+
+	db := pg.Connect(&pg.Options{
+		Addr:     DB_ADDR,
+		User:     os.Getenv("DB_USERNAME"),
+		Password: os.Getenv("DB_PASSWORD"),
+		Database: os.Getenv("DB"),
+		PoolSize: DB_POOL_SIZE,
+	})
+
+	migratePostgres(db)
+
+	// Prints out the queries created by go-pg.
+	if SHOW_QUERIES {
+		db.OnQueryProcessed(func(event *pg.QueryProcessedEvent) {
+			query, err := event.FormattedQuery()
+			if err != nil {
+				fatal("Error formatting processed query: ", err)
+			}
+
+			log.Printf("%s %s", time.Since(event.StartTime), query)
+		})
+	}
+
+	return db
+}
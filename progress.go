@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const PROGRESS_FORMAT_VERSION = 1
+
+// A progressRecord is the contents of a progress file in WORKER_PROGRESS_DIR.
+// Heights in [Start, Last) are stored, [Last, End) is left to do.
+type progressRecord struct {
+	Version int `json:"version"`
+
+	Start int `json:"start"`
+	Last  int `json:"last"`
+	End   int `json:"end"`
+
+	// Worker is -1 until a worker takes on the chunk.
+	Worker int    `json:"worker"`
+	Host   string `json:"host"`
+	Pid    int    `json:"pid"`
+
+	// Lock is the name of the lock file (in the same directory) held by the process working on this record.
+	Lock string `json:"lock"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// lockPath returns the path of the lock file for the record stored at path.
+func (record progressRecord) lockPath(path string) string {
+	if record.Lock == "" {
+		return path + ".lock"
+	}
+	return fmt.Sprintf("%v/%v", WORKER_PROGRESS_DIR, record.Lock)
+}
+
+// writeProgress replaces the progress file at path. The record is written to a temporary
+// file first and renamed over the old one, so a crash never leaves a half written record.
+func writeProgress(path string, record progressRecord) error {
+	contents, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(contents)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// readProgress reads the progress file at path.
+func readProgress(path string) (progressRecord, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return progressRecord{}, err
+	}
+
+	return parseProgress(string(contents))
+}
+
+// parseProgress parses the contents of a progress file.
+// Files in the old "Start=/Last=/End=" format are still accepted.
+func parseProgress(contents string) (progressRecord, error) {
+	var record progressRecord
+	if strings.HasPrefix(strings.TrimSpace(contents), "{") {
+		err := json.Unmarshal([]byte(contents), &record)
+		if err != nil {
+			return record, err
+		}
+		if record.Version > PROGRESS_FORMAT_VERSION {
+			return record, fmt.Errorf("unknown progress format version %v", record.Version)
+		}
+	} else {
+		record.Worker = -1
+
+		// Older versions wrote over the file without truncating it, so there can be junk after End.
+		fields := make(map[string]int)
+		for _, line := range strings.Split(contents, "\n") {
+			split := strings.SplitN(line, "=", 2)
+			if len(split) < 2 {
+				continue
+			}
+
+			height, err := strconv.Atoi(strings.TrimSpace(split[1]))
+			if err != nil {
+				continue
+			}
+			if _, ok := fields[split[0]]; !ok {
+				fields[split[0]] = height
+			}
+		}
+
+		var ok1, ok2, ok3 bool
+		record.Start, ok1 = fields["Start"]
+		record.Last, ok2 = fields["Last"]
+		record.End, ok3 = fields["End"]
+		if !(ok1 && ok2 && ok3) {
+			return record, fmt.Errorf("missing Start, Last or End")
+		}
+	}
+
+	if record.Start > record.Last || record.Last > record.End {
+		return record, fmt.Errorf("inconsistent range: start %v, last %v, end %v", record.Start, record.Last, record.End)
+	}
+
+	return record, nil
+}
+
+// lockFile takes an exclusive advisory lock on the file at path, creating it if needed.
+// It fails right away if another process holds the lock. The lock is held until unlockFile
+// is called or the process exits.
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// unlockFile releases a lock taken with lockFile, and removes the lock file if remove is set.
+// The file is removed while still locked, so nobody can take a lock on it that is about to disappear.
+func unlockFile(file *os.File, remove bool) {
+	if remove {
+		os.Remove(file.Name())
+	}
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	file.Close()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseProgress(t *testing.T) {
+	// Older versions wrote a shorter record over a longer one without truncating the file.
+	overwritten := []byte("Start=0\nLast=99999\nEnd=100000\n")
+	copy(overwritten, "Start=0\nLast=5\nEnd=10\n")
+
+	tests := []struct {
+		name     string
+		contents string
+		want     progressRecord
+		err      string
+	}{
+		{
+			name:     "legacy",
+			contents: "Start=0\nLast=50\nEnd=100\n",
+			want:     progressRecord{Start: 0, Last: 50, End: 100, Worker: -1},
+		},
+		{
+			name:     "legacy with junk after End",
+			contents: string(overwritten),
+			want:     progressRecord{Start: 0, Last: 5, End: 10, Worker: -1},
+		},
+		{
+			name:     "legacy with a second End",
+			contents: "Start=0\nLast=5\nEnd=10\nEnd=100000\n",
+			want:     progressRecord{Start: 0, Last: 5, End: 10, Worker: -1},
+		},
+		{
+			name:     "legacy without trailing newline",
+			contents: "Start=10\nLast=10\nEnd=20",
+			want:     progressRecord{Start: 10, Last: 10, End: 20, Worker: -1},
+		},
+		{
+			name:     "legacy truncated",
+			contents: "Start=0\nLast=5",
+			err:      "missing Start, Last or End",
+		},
+		{
+			name:     "empty",
+			contents: "",
+			err:      "missing Start, Last or End",
+		},
+		{
+			name:     "legacy inconsistent range",
+			contents: "Start=0\nLast=150\nEnd=100\n",
+			err:      "inconsistent range",
+		},
+		{
+			name:     "current version",
+			contents: `{"version": 1, "start": 100, "last": 120, "end": 200, "worker": 3, "host": "node", "pid": 42, "lock": "chunk-1.lock"}`,
+			want:     progressRecord{Version: 1, Start: 100, Last: 120, End: 200, Worker: 3, Host: "node", Pid: 42, Lock: "chunk-1.lock"},
+		},
+		{
+			name:     "truncated JSON",
+			contents: `{"version": 1, "start": 100, "la`,
+			err:      "unexpected end of JSON input",
+		},
+		{
+			name:     "future version",
+			contents: `{"version": 2, "start": 100, "last": 120, "end": 200}`,
+			err:      "unknown progress format version 2",
+		},
+		{
+			name:     "inconsistent range",
+			contents: `{"version": 1, "start": 100, "last": 90, "end": 200}`,
+			err:      "inconsistent range",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record, err := parseProgress(test.contents)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if record != test.want {
+				t.Errorf("got %+v, want %+v", record, test.want)
+			}
+		})
+	}
+}
+
+func TestProgressRoundTrip(t *testing.T) {
+	useBackfillSettings(t)
+
+	path := WORKER_PROGRESS_DIR + "/chunk-test-0-100"
+	want := progressRecord{Version: PROGRESS_FORMAT_VERSION, Start: 0, Last: 40, End: 100, Worker: 2, Lock: "chunk-test.lock"}
+	if err := writeProgress(path, want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readProgress(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("read %+v, want %+v", got, want)
+	}
+	if lockPath := got.lockPath(path); lockPath != WORKER_PROGRESS_DIR+"/chunk-test.lock" {
+		t.Errorf("lock path %v", lockPath)
+	}
+}
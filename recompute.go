@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+const RECOMPUTE_PAGE_SIZE = 1000
+
+// recomputeDerived rebuilds the derived columns of every stored block in [start, end) from its raw columns,
+// e.g. after a formula in computeDerived was fixed. Nothing is fetched from bitcoind.
+// Rows are rewritten with CURRENT_VERSION_NUMBER if their values or version changed.
+// An end of 0 means up to the highest stored height.
+func recomputeDerived(start, end int64) {
+	if end <= start {
+		end = 1<<63 - 1
+	}
+	log.Printf("Recomputing derived columns of stored blocks from height %v\n", start)
+	startTime := time.Now()
+
+	if USE_POSTGRES {
+		worker := setupWorker()
+		checked, changed := worker.recomputePostgres(start, end)
+		log.Printf("Recomputed %v Postgres rows, %v changed\n", checked, changed)
+	}
+
+	if BACKUP_JSON {
+		checked, changed := recomputeJSON(start, end)
+		log.Printf("Recomputed %v JSON backups, %v changed\n", checked, changed)
+	}
+
+	log.Printf("Recomputing derived columns took %v\n", time.Since(startTime))
+}
+
+// recomputePostgres pages through the rows in [start, end) by height, updating each page in one transaction.
+// Stops between pages on SIGINT or SIGTERM.
+func (worker *Worker) recomputePostgres(start, end int64) (checked, changed int) {
+	for {
+		if stopRequested() {
+			log.Printf("Stopped recomputing Postgres rows at height %v, continue with -start=%v\n", start, start)
+			return checked, changed
+		}
+
+		var rows []DashboardDataV2
+		err := retry("PG select", func() error {
+			return worker.pgClient.Model(&rows).
+				Where("height >= ? AND height < ?", start, end).
+				Order("height ASC").
+				Limit(RECOMPUTE_PAGE_SIZE).
+				Select()
+		})
+		if err != nil {
+			fatal("Error selecting stored blocks: ", err)
+		}
+		if len(rows) == 0 {
+			return checked, changed
+		}
+
+		updates := make([]DashboardDataV2, 0)
+		for _, row := range rows {
+			recomputed := row
+			recomputed.computeDerived()
+
+			if len(diffFields(row, recomputed)) > 0 {
+				changed++
+			} else if row.Version == recomputed.Version {
+				continue
+			}
+			updates = append(updates, recomputed)
+		}
+		checked += len(rows)
+
+		err = retry("PG update", func() error {
+			return worker.pgClient.RunInTransaction(func(tx *pg.Tx) error {
+				return updateRollups(tx, rowHeights(updates), func() error {
+					for i := range updates {
+						err := tx.Update(&updates[i])
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+			})
+		})
+		if err != nil {
+			fatal("Error updating recomputed blocks: ", err)
+		}
+
+		start = rows[len(rows)-1].Height + 1
+		log.Printf("Recomputed Postgres rows up to height %v (%v changed so far)\n", start-1, changed)
+	}
+}
+
+// recomputeJSON rewrites the JSON backups in [start, end) whose derived values or version changed.
+// Stops between files on SIGINT or SIGTERM.
+func recomputeJSON(start, end int64) (checked, changed int) {
+	for _, height := range storedJSONHeights() {
+		if height < start || height >= end {
+			continue
+		}
+
+		if stopRequested() {
+			log.Printf("Stopped recomputing JSON backups at height %v, continue with -start=%v\n", height, height)
+			return checked, changed
+		}
+
+		data, ok := readDataFile(height)
+		if !ok {
+			continue
+		}
+		checked++
+
+		recomputed := data.DashboardDataRow
+		recomputed.computeDerived()
+
+		if len(diffFields(data.DashboardDataRow, recomputed)) > 0 {
+			changed++
+		} else if data.Version == CURRENT_VERSION_NUMBER {
+			continue
+		}
+		storeDataAsFile(Data{CURRENT_VERSION_NUMBER, recomputed})
+	}
+
+	return checked, changed
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/go-pg/pg"
+)
+
+// MAX_REORG_DEPTH is how far below the tip live analysis looks for a fork point.
+// Anything deeper than this is treated as a fatal error, since it most likely means
+// bitcoind and the database disagree about which network they are on.
+const MAX_REORG_DEPTH = 100
+
+// chainTracker remembers the block hash stored for each recently analyzed height
+// so that live analysis can notice when the chain under it changes.
+type chainTracker struct {
+	mu      sync.Mutex
+	hashes  map[int64]string
+	pending map[int64]bool
+}
+
+func newChainTracker() *chainTracker {
+	return &chainTracker{
+		hashes:  make(map[int64]string),
+		pending: make(map[int64]bool),
+	}
+}
+
+// start marks a height as being analyzed, its hash isn't known until it is stored.
+func (ct *chainTracker) start(height int64) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	ct.pending[height] = true
+}
+
+// record stores the hash of a block that was just stored at the given height.
+func (ct *chainTracker) record(height int64, hash string) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	delete(ct.pending, height)
+	ct.hashes[height] = hash
+
+	// Only the last MAX_REORG_DEPTH blocks can be re-organized.
+	delete(ct.hashes, height-MAX_REORG_DEPTH)
+}
+
+// abandon clears the pending mark of a height whose analysis did not finish.
+func (ct *chainTracker) abandon(height int64) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	delete(ct.pending, height)
+}
+
+func (ct *chainTracker) isPending(height int64) bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	return ct.pending[height]
+}
+
+// forgetAbove drops every hash recorded above the given height.
+func (ct *chainTracker) forgetAbove(height int64) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	for h := range ct.hashes {
+		if h > height {
+			delete(ct.hashes, h)
+		}
+	}
+}
+
+// storedHash returns the hash stored for a height, looking in Postgres (or the JSON backups)
+// if the height was stored before this run started.
+func (ct *chainTracker) storedHash(worker *Worker, height int64) (string, bool) {
+	ct.mu.Lock()
+	hash, ok := ct.hashes[height]
+	ct.mu.Unlock()
+
+	if ok {
+		return hash, true
+	}
+
+	if !USE_POSTGRES {
+		data, ok := readDataFile(height)
+		return data.DashboardDataRow.Hash, ok
+	}
+
+	var row DashboardDataV2
+	err := worker.pgClient.Model(&row).Column("hash").Where("height = ?", height).Select()
+	if err == pg.ErrNoRows {
+		return "", false
+	}
+	if err != nil {
+		fatal("Error looking up stored block hash: ", err)
+	}
+
+	return row.Hash, true
+}
+
+// bestChainHash returns the hash of the block at the given height in bitcoind's best chain.
+// The second return value is false if the best chain doesn't reach that height (anymore).
+func (worker *Worker) bestChainHash(height int64) (string, bool) {
+	blockCount := worker.getBlockCount()
+	if height > blockCount {
+		return "", false
+	}
+
+	var hash *chainhash.Hash
+	err := retry("getblockhash", func() (err error) {
+		hash, err = worker.client.GetBlockHash(height)
+		return err
+	})
+	if err != nil {
+		fatal("Error with getblockhash RPC: ", err)
+	}
+
+	return hash.String(), true
+}
+
+// nextBlockHash returns the hash of the block at the given height in the best chain, if it builds on
+// the block stored at the height below. Live analysis fetches the block by this hash, so a reorg right
+// after the check can't put a block of the new branch on top of a stale one.
+// The second return value is false if the block doesn't exist or builds on something else.
+func (worker *Worker) nextBlockHash(tracker *chainTracker, height int64) (string, bool) {
+	hash, ok := worker.bestChainHash(height)
+	if !ok {
+		return "", false
+	}
+
+	parent, ok := tracker.storedHash(worker, height-1)
+	if !ok {
+		// Nothing stored below, so nothing to build on.
+		return hash, true
+	}
+
+	blockHash, err := chainhash.NewHashFromStr(hash)
+	if err != nil {
+		fatal("Error parsing block hash: ", err)
+	}
+
+	var header *btcjson.GetBlockHeaderVerboseResult
+	err = retry("getblockheader", func() (err error) {
+		header, err = worker.client.GetBlockHeaderVerbose(blockHash)
+		return err
+	})
+	if err != nil {
+		fatal("Error with getblockheader RPC: ", err)
+	}
+
+	if header.PreviousHash != parent {
+		log.Printf("Block %v at height %v doesn't build on the stored block %v\n", hash, height, parent)
+		return "", false
+	}
+
+	return hash, true
+}
+
+// findReorg checks whether the block stored at the given height is still in the best chain.
+// If it isn't, it returns the height of the last block both chains have in common.
+func (worker *Worker) findReorg(tracker *chainTracker, height int64) (int64, bool) {
+	stored, ok := tracker.storedHash(worker, height)
+	if !ok {
+		// Nothing stored here, so nothing to compare against.
+		return 0, false
+	}
+
+	if current, ok := worker.bestChainHash(height); ok && current == stored {
+		return 0, false
+	}
+
+	for fork := height - 1; fork > height-MAX_REORG_DEPTH && fork >= 0; fork-- {
+		stored, ok := tracker.storedHash(worker, fork)
+		if !ok {
+			continue
+		}
+
+		if current, ok := worker.bestChainHash(fork); ok && current == stored {
+			log.Printf("Reorg detected: block at height %v (%v) is no longer in the best chain, fork point is %v\n", height, stored, fork)
+			return fork, true
+		}
+	}
+
+	fatal(fmt.Sprintf("Reorg deeper than %v blocks below height %v", MAX_REORG_DEPTH, height))
+	return 0, false
+}
+
+// moveToStaleBlocks moves the rows in (fork, end) into the stale_blocks table.
+func (worker *Worker) moveToStaleBlocks(fork, end int64) {
+	var rows []DashboardDataV2
+	err := retry("PG select", func() error {
+		return worker.pgClient.Model(&rows).Where("height > ? AND height < ?", fork, end).Select()
+	})
+	if err != nil {
+		fatal("Error selecting reorged blocks: ", err)
+	}
+
+	// The blocks that replaced them, looked up once per height before the rows are moved.
+	tipHeight := worker.getBlockCount()
+	replacedBy := make(map[int64]string)
+	for height := fork + 1; height < end && height <= tipHeight; height++ {
+		var hash *chainhash.Hash
+		err := retry("getblockhash", func() (err error) {
+			hash, err = worker.client.GetBlockHash(height)
+			return err
+		})
+		if err != nil {
+			fatal("Error with getblockhash RPC: ", err)
+		}
+		replacedBy[height] = hash.String()
+	}
+	tipHash, _ := worker.bestChainHash(tipHeight)
+
+	detectedAt := time.Now().Unix()
+	staleBlocks := make([]StaleBlock, len(rows))
+	for i, row := range rows {
+		staleBlocks[i] = StaleBlock{
+			Hash:               row.Hash,
+			Height:             row.Height,
+			Replaced_by_height: tipHeight,
+			Replaced_by_hash:   tipHash,
+			Detected_at:        detectedAt,
+			DashboardDataRow:   row,
+		}
+
+		if hash, ok := replacedBy[row.Height]; ok {
+			staleBlocks[i].Replaced_by_height = row.Height
+			staleBlocks[i].Replaced_by_hash = hash
+		}
+	}
+
+	err = worker.pgClient.RunInTransaction(func(tx *pg.Tx) error {
+		if len(staleBlocks) > 0 {
+			// A block can be reorged out more than once if it comes back in between.
+			_, err := tx.Model(&staleBlocks).OnConflict("DO NOTHING").Insert()
+			if err != nil {
+				return err
+			}
+		}
+
+		return updateRollups(tx, rowHeights(rows), func() error {
+			_, err := tx.Model((*DashboardDataV2)(nil)).Where("height > ? AND height < ?", fork, end).Delete()
+			return err
+		})
+	})
+	if err != nil {
+		fatal("Error rolling back reorged blocks: ", err)
+	}
+	log.Printf("Moved %v reorged blocks in (%v, %v) to stale_blocks\n", len(staleBlocks), fork, end)
+}
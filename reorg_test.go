@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+)
+
+// useFakeChain answers getblockcount, getblockhash and getblockheader from a chain of hashes by height,
+// where parents maps a hash to the hash of the block it builds on.
+func useFakeChain(fake *fakeBitcoind, chain []string, parents map[string]string) {
+	fake.call = func(method string, params []json.RawMessage) (interface{}, *btcjson.RPCError, bool) {
+		switch method {
+		case "getblockcount":
+			return len(chain) - 1, nil, true
+		case "getblockhash":
+			var height int
+			json.Unmarshal(params[0], &height)
+			if height >= len(chain) {
+				return nil, &btcjson.RPCError{Code: btcjson.ErrRPCInvalidParameter, Message: "Block height out of range"}, true
+			}
+			return chain[height], nil, true
+		case "getblockheader":
+			var hash string
+			json.Unmarshal(params[0], &hash)
+			return map[string]interface{}{"hash": hash, "previousblockhash": parents[hash]}, nil, true
+		}
+		return nil, &btcjson.RPCError{Code: btcjson.ErrRPCMisc, Message: "unexpected " + method}, true
+	}
+}
+
+func testHash(name string) string {
+	return fmt.Sprintf("%064x", []byte(name))[:64]
+}
+
+func TestNextBlockHash(t *testing.T) {
+	fake := newFakeBitcoind(t)
+	worker := setupWorker()
+
+	a, b, c, cOnB := testHash("a"), testHash("b"), testHash("c"), testHash("c on b")
+	parents := map[string]string{b: a, c: b, cOnB: testHash("b'")}
+
+	tests := []struct {
+		name   string
+		chain  []string
+		stored map[int64]string
+		want   string
+		wantOK bool
+	}{
+		{"builds on stored block", []string{a, b, c}, map[int64]string{1: b}, c, true},
+		{"stored block was reorged out", []string{a, b, cOnB}, map[int64]string{1: b}, "", false},
+		{"nothing stored below", []string{a, b, c}, map[int64]string{}, c, true},
+		{"chain doesn't reach the height", []string{a, b}, map[int64]string{1: b}, "", false},
+	}
+
+	for _, test := range tests {
+		useFakeChain(fake, test.chain, parents)
+		tracker := newChainTracker()
+		for height, hash := range test.stored {
+			tracker.record(height, hash)
+		}
+
+		// Heights without a recorded hash would be looked up in the JSON backups.
+		USE_POSTGRES = false
+		JSON_DIR = t.TempDir()
+
+		got, ok := worker.nextBlockHash(tracker, 2)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("%v: nextBlockHash = %q, %v, want %q, %v", test.name, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestMoveToStaleBlocksStopsAtEnd(t *testing.T) {
+	fake := newFakeBitcoind(t)
+	usePostgres(t)
+	worker := setupWorker()
+
+	savedRollups, savedOnConflict := ROLLUPS, ON_CONFLICT
+	t.Cleanup(func() { ROLLUPS, ON_CONFLICT = savedRollups, savedOnConflict })
+	ROLLUPS, ON_CONFLICT = false, ON_CONFLICT_SKIP
+
+	// Far above any real height, so the scratch database can hold other rows too.
+	const base = 900000000
+	clear := func() {
+		for _, table := range []string{"dashboard_data_v2", "stale_blocks"} {
+			_, err := pgPool.Exec(fmt.Sprintf("DELETE FROM %v WHERE height >= ?", table), base)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	clear()
+	t.Cleanup(clear)
+
+	rows := make([]DashboardDataV2, 0)
+	for height := int64(base + 1); height <= base+8; height++ {
+		rows = append(rows, storableRow(height, testHash(fmt.Sprint("old", height)), CURRENT_VERSION_NUMBER))
+	}
+	if _, err := upsertRows(pgPool, rows); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.call = func(method string, params []json.RawMessage) (interface{}, *btcjson.RPCError, bool) {
+		switch method {
+		case "getblockcount":
+			return base + 9, nil, true
+		case "getblockhash":
+			var height int64
+			json.Unmarshal(params[0], &height)
+			return testHash(fmt.Sprint("new", height)), nil, true
+		}
+		return nil, &btcjson.RPCError{Code: btcjson.ErrRPCMisc, Message: "unexpected " + method}, true
+	}
+
+	worker.moveToStaleBlocks(base+3, base+6)
+
+	var left []int64
+	_, err := pgPool.Query(&left, `SELECT height FROM dashboard_data_v2 WHERE height >= ? ORDER BY height`, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{base + 1, base + 2, base + 3, base + 6, base + 7, base + 8}
+	if fmt.Sprint(left) != fmt.Sprint(want) {
+		t.Errorf("heights left: %v, want %v", left, want)
+	}
+
+	var stale []StaleBlock
+	err = pgPool.Model(&stale).Where("height >= ?", base).Order("height").Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 2 || stale[0].Height != base+4 || stale[1].Height != base+5 {
+		t.Fatalf("stale blocks: %+v, want heights %v and %v", stale, base+4, base+5)
+	}
+	if stale[0].Replaced_by_hash != testHash(fmt.Sprint("new", base+4)) {
+		t.Errorf("block at %v replaced by %v", stale[0].Height, stale[0].Replaced_by_hash)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/go-pg/pg"
+)
+
+const RETRY_BASE_DELAY_DEFAULT = 1 * time.Second
+const RETRY_MAX_DELAY_DEFAULT = 2 * time.Minute
+
+// retry calls fn until it succeeds, fails with a permanent error, or MAX_ATTEMPTS calls have failed.
+// The wait between attempts doubles from RETRY_BASE_DELAY up to RETRY_MAX_DELAY, with jitter so that
+// many workers retrying at once don't all hit bitcoind or Postgres at the same moment.
+func retry(what string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		if !isTransient(err) || attempt >= MAX_ATTEMPTS {
+			return err
+		}
+
+		delay := backoff(attempt)
+		log.Printf("%v failed (attempt %v/%v), retrying in %v: %v\n", what, attempt, MAX_ATTEMPTS, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// backoff returns how long to wait after the given failed attempt.
+func backoff(attempt int) time.Duration {
+	// Doubled one step at a time up to the cap, shifting by the attempt would overflow after enough of them.
+	delay := RETRY_BASE_DELAY
+	for i := 1; i < attempt && delay > 0 && delay < RETRY_MAX_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > RETRY_MAX_DELAY || delay < 0 {
+		delay = RETRY_MAX_DELAY
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	// Wait at least half the delay, the rest is random.
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// isTransient classifies errors from RPC and Postgres calls.
+// Transient errors are worth retrying, permanent ones (bad queries, duplicate keys,
+// invalid RPC parameters) will fail the same way every time.
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case pg.Error:
+		code := e.Field('C')
+		if len(code) < 2 {
+			return false
+		}
+
+		// SQLSTATE classes: 08 connection exception, 40 transaction rollback (e.g. deadlock),
+		// 53 insufficient resources, 57 operator intervention (e.g. admin shutdown).
+		switch code[:2] {
+		case "08", "40", "53", "57":
+			return true
+		}
+		return false
+	case *btcjson.RPCError:
+		// bitcoind answered, the only error worth waiting out is warmup after a restart.
+		return e.Code == btcjson.ErrRPCInWarmup
+	case net.Error:
+		return true
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	// rpcclient in HTTP POST mode reports HTTP and connection failures as plain errors,
+	// e.g. "503 Service Unavailable" when bitcoind's RPC work queue is full.
+	msg := err.Error()
+	for _, transient := range []string{"503", "Work queue depth exceeded", "connection refused", "connection reset", "broken pipe", "EOF", "timeout"} {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	savedBase, savedMax := RETRY_BASE_DELAY, RETRY_MAX_DELAY
+	t.Cleanup(func() { RETRY_BASE_DELAY, RETRY_MAX_DELAY = savedBase, savedMax })
+
+	tests := []struct {
+		base, max time.Duration
+		attempt   int
+		want      time.Duration
+	}{
+		{time.Second, 2 * time.Minute, 1, time.Second},
+		{time.Second, 2 * time.Minute, 3, 4 * time.Second},
+		{time.Second, 2 * time.Minute, 8, 2 * time.Minute},
+		{time.Second, 2 * time.Minute, 1000, 2 * time.Minute},
+		// Shifting an hour by 40 overflows.
+		{time.Hour, 24 * time.Hour, 40, 24 * time.Hour},
+		{time.Hour, math.MaxInt64, 100, math.MaxInt64},
+		{0, time.Minute, 5, 0},
+	}
+
+	for _, test := range tests {
+		RETRY_BASE_DELAY, RETRY_MAX_DELAY = test.base, test.max
+		for i := 0; i < 10; i++ {
+			delay := backoff(test.attempt)
+			if delay < test.want/2 || delay > test.want {
+				t.Errorf("backoff(%v) with -retry-delay=%v -retry-max-delay=%v = %v, want between %v and %v",
+					test.attempt, test.base, test.max, delay, test.want/2, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// Any number taken by nothing else, for the advisory lock held while rollups are updated,
+// so that processes writing blocks in the same bucket at the same time take turns.
+const ROLLUP_LOCK_ID = 73127
+
+// How often live analysis recomputes the columns of lazy rollup periods that fell behind, see refreshStaleRollups.
+const ROLLUP_REFRESH_INTERVAL = time.Hour
+
+// A rollupPeriod is a table of aggregates over the blocks in buckets of a fixed size, either in time or in height.
+// Each row's bucket is where it starts: a unix time for time buckets, and the first height for height buckets.
+type rollupPeriod struct {
+	table  string
+	column string
+	size   int64
+	offset int64
+
+	// The min, max and percentile columns of lazy periods aren't recomputed on every write, their buckets
+	// are too big for that. refreshStaleRollups catches them up later.
+	lazy bool
+}
+
+var rollupPeriods = []rollupPeriod{
+	{"rollup_daily", "time", 24 * 60 * 60, 0, false},
+	// ISO weeks start on Monday, and the first Monday after the unix epoch is 1970-01-05.
+	{"rollup_weekly", "time", 7 * 24 * 60 * 60, 4 * 24 * 60 * 60, false},
+	{"rollup_difficulty_epoch", "height", 2016, 0, true},
+	{"rollup_halving_epoch", "height", 210000, 0, true},
+}
+
+// How a rollup column is kept up to date.
+const (
+	// Sums are added to and subtracted from as blocks come and go.
+	rollupSum = iota
+	// Minimums and maximums follow added blocks, and are recomputed from all blocks of the bucket.
+	rollupMin
+	rollupMax
+	// Averages are computed from sums of the same row.
+	rollupAverage
+	// Percentiles are recomputed from all blocks of the bucket.
+	rollupPercentiles
+)
+
+// A rollupColumn is one aggregate of the dashboard_data_v2 rows in a bucket. expr is an expression
+// over a dashboard_data_v2 row, except for averages where it is over the other columns of the rollup.
+type rollupColumn struct {
+	name    string
+	sqlType string
+	kind    int
+	expr    string
+}
+
+// Percentiles are 10th, 25th, 50th, 75th and 90th, like the feerate_percentiles of a block.
+const ROLLUP_PERCENTILES = "ARRAY[0.1, 0.25, 0.5, 0.75, 0.9]"
+
+// Migration 5 creates the rollup tables from these, so adding a column also takes a migration that adds it
+// to existing tables with ADD COLUMN IF NOT EXISTS, since on a new database migration 5 already did, and rebuilds them.
+var rollupColumns = []rollupColumn{
+	{"blocks", "bigint", rollupSum, "1"},
+	{"first_height", "bigint", rollupMin, "height"},
+	{"last_height", "bigint", rollupMax, "height"},
+	{"first_time", "bigint", rollupMin, "time"},
+	{"last_time", "bigint", rollupMax, "time"},
+
+	{"num_txs", "bigint", rollupSum, "num_txs"},
+	{"num_inputs", "bigint", rollupSum, "num_inputs"},
+	{"num_outputs", "bigint", rollupSum, "num_outputs"},
+	{"num_segwit_txs", "bigint", rollupSum, "num_segwit_txs"},
+	{"total_fee", "bigint", rollupSum, "total_fee"},
+	{"subsidy", "bigint", rollupSum, "subsidy"},
+	{"total_amount_out", "bigint", rollupSum, "total_amount_out"},
+	{"total_block_size", "bigint", rollupSum, "total_block_size"},
+	{"total_weight", "bigint", rollupSum, "total_weight"},
+	{"utxo_increase", "bigint", rollupSum, "utxo_increase"},
+	{"txs_signalling_opt_in_rbf", "bigint", rollupSum, "txs_signalling_opt_in_rbf"},
+	{"consolidating_txs", "bigint", rollupSum, "consolidating_txs"},
+	{"outputs_consolidated", "bigint", rollupSum, "outputs_consolidated"},
+	{"batching_txs", "bigint", rollupSum, "batching_txs"},
+
+	// Per-transaction averages of blocks are weighted by their number of transactions, leaving out the coinbase
+	// like getblockstats does, and fee rates by weight. The weighted sums are numeric, so subtracting is exact.
+	{"non_coinbase_txs", "bigint", rollupSum, "num_txs - 1"},
+	{"weighted_avg_fee", "numeric", rollupSum, "avg_fee * (num_txs - 1)"},
+	{"weighted_avg_tx_size", "numeric", rollupSum, "avg_tx_size * (num_txs - 1)"},
+	{"weighted_avg_fee_rate", "numeric", rollupSum, "avg_fee_rate * total_weight"},
+	{"weighted_percent_inputs_consolidated", "numeric", rollupSum, "percent_inputs_consolidated::numeric * num_inputs"},
+
+	// NULL if there is nothing to weigh.
+	{"avg_fee", "double precision", rollupAverage, "weighted_avg_fee / nullif(non_coinbase_txs, 0)"},
+	{"avg_tx_size", "double precision", rollupAverage, "weighted_avg_tx_size / nullif(non_coinbase_txs, 0)"},
+	{"avg_fee_rate", "double precision", rollupAverage, "weighted_avg_fee_rate / nullif(total_weight, 0)"},
+	{"percent_inputs_consolidated", "double precision", rollupAverage, "weighted_percent_inputs_consolidated / nullif(num_inputs, 0)"},
+
+	// Percentiles over the blocks in the bucket.
+	{"median_feerate_percentiles", "double precision[]", rollupPercentiles, "feerate_percentiles[3]"},
+	{"block_size_percentiles", "double precision[]", rollupPercentiles, "total_block_size"},
+	{"num_txs_percentiles", "double precision[]", rollupPercentiles, "num_txs"},
+}
+
+// aggregate returns the aggregate of a column over dashboard_data_v2 rows, sums are multiplied by sign.
+func (c rollupColumn) aggregate(sign int) string {
+	switch c.kind {
+	case rollupSum:
+		return fmt.Sprintf("%v * sum(%v)", sign, c.expr)
+	case rollupMin:
+		return fmt.Sprintf("min(%v)", c.expr)
+	case rollupMax:
+		return fmt.Sprintf("max(%v)", c.expr)
+	case rollupPercentiles:
+		return fmt.Sprintf("percentile_cont(%v) WITHIN GROUP (ORDER BY %v)", ROLLUP_PERCENTILES, c.expr)
+	}
+	return ""
+}
+
+// bucket returns the bucket a block falls in.
+func (p rollupPeriod) bucket(row DashboardDataV2) int64 {
+	value := row.Height
+	if p.column == "time" {
+		value = row.Time
+	}
+	return value - (value-p.offset)%p.size
+}
+
+// bucketExpr is bucket written as SQL.
+func (p rollupPeriod) bucketExpr() string {
+	return fmt.Sprintf("%v - (%v - %v) %% %v", p.column, p.column, p.offset, p.size)
+}
+
+// createTable creates the table of a period, see migrations.
+// changes counts the writes to a bucket, and recomputed_changes is what it was when the min, max and percentile
+// columns were last recomputed, so a bucket with recomputed_changes < changes has fallen behind.
+func (p rollupPeriod) createTable(tx pgExecer) error {
+	columns := []string{"bucket bigint PRIMARY KEY", "changes bigint NOT NULL DEFAULT 0", "recomputed_changes bigint NOT NULL DEFAULT 0"}
+	for _, c := range rollupColumns {
+		columns = append(columns, c.name+" "+c.sqlType)
+	}
+
+	_, err := tx.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v (%v)", p.table, strings.Join(columns, ", ")))
+	return err
+}
+
+// apply adds the dashboard_data_v2 rows at the given heights to the buckets they fall in, or subtracts them
+// if sign is -1. Sums are exact either way, minimums and maximums only follow added rows.
+// Returns the buckets it touched.
+func (p rollupPeriod) apply(tx pgExecer, heights []int64, sign int) ([]int64, error) {
+	names := []string{"bucket", "changes"}
+	exprs := []string{p.bucketExpr(), "1"}
+	set := []string{"changes = r.changes + 1"}
+	for _, c := range rollupColumns {
+		switch c.kind {
+		case rollupSum:
+			set = append(set, fmt.Sprintf("%v = r.%v + EXCLUDED.%v", c.name, c.name, c.name))
+		case rollupMin:
+			set = append(set, fmt.Sprintf("%v = least(r.%v, EXCLUDED.%v)", c.name, c.name, c.name))
+		case rollupMax:
+			set = append(set, fmt.Sprintf("%v = greatest(r.%v, EXCLUDED.%v)", c.name, c.name, c.name))
+		default:
+			continue
+		}
+		names = append(names, c.name)
+		exprs = append(exprs, c.aggregate(sign))
+	}
+
+	var buckets pg.Ints
+	_, err := tx.Query(&buckets, fmt.Sprintf(
+		"INSERT INTO %v AS r (%v) SELECT %v FROM dashboard_data_v2 WHERE height IN (?) GROUP BY 1 ON CONFLICT (bucket) DO UPDATE SET %v RETURNING bucket",
+		p.table, strings.Join(names, ", "), strings.Join(exprs, ", "), strings.Join(set, ", ")), pg.In(heights))
+
+	return buckets, err
+}
+
+// recomputeQuery returns the query that recomputes the min, max and percentile columns of the buckets
+// in IN (?) from all their blocks in [?, ?), and sets recomputed_changes to recomputed.
+func (p rollupPeriod) recomputeQuery(recomputed string) string {
+	set := []string{"recomputed_changes = " + recomputed}
+	exprs := []string{p.bucketExpr() + " AS bucket"}
+	for _, c := range rollupColumns {
+		if c.kind == rollupMin || c.kind == rollupMax || c.kind == rollupPercentiles {
+			set = append(set, fmt.Sprintf("%v = s.%v", c.name, c.name))
+			exprs = append(exprs, fmt.Sprintf("%v AS %v", c.aggregate(1), c.name))
+		}
+	}
+
+	return fmt.Sprintf("UPDATE %v AS r SET %v FROM (SELECT %v FROM dashboard_data_v2 WHERE %v >= ? AND %v < ? GROUP BY 1) AS s WHERE r.bucket = s.bucket AND r.bucket IN (?)",
+		p.table, strings.Join(set, ", "), strings.Join(exprs, ", "), p.column, p.column)
+}
+
+// averagesSet returns the SET list that computes the averages of a rollup row from its sums.
+func averagesSet() string {
+	set := make([]string, 0)
+	for _, c := range rollupColumns {
+		if c.kind == rollupAverage {
+			set = append(set, fmt.Sprintf("%v = %v", c.name, c.expr))
+		}
+	}
+	return strings.Join(set, ", ")
+}
+
+// updateBuckets brings the given buckets up to date after rows were applied to them: buckets without
+// blocks left are removed, and the averages are computed from the sums. The min, max and percentile
+// columns are recomputed too, unless the period is lazy.
+func (p rollupPeriod) updateBuckets(tx pgExecer, buckets []int64) error {
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(fmt.Sprintf("DELETE FROM %v WHERE bucket IN (?) AND blocks <= 0", p.table), pg.In(buckets))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("UPDATE %v SET %v WHERE bucket IN (?)", p.table, averagesSet()), pg.In(buckets))
+	if err != nil || p.lazy {
+		return err
+	}
+
+	first, last := buckets[0], buckets[0]
+	for _, bucket := range buckets[1:] {
+		if bucket < first {
+			first = bucket
+		}
+		if bucket > last {
+			last = bucket
+		}
+	}
+	_, err = tx.Exec(p.recomputeQuery("r.changes"), first, last+p.size, pg.In(buckets))
+	return err
+}
+
+// rebuild recomputes all buckets of a period.
+func (p rollupPeriod) rebuild(tx pgExecer) error {
+	_, err := tx.Exec(fmt.Sprintf("TRUNCATE %v", p.table))
+	if err != nil {
+		return err
+	}
+
+	names := []string{"bucket", "changes", "recomputed_changes"}
+	exprs := []string{p.bucketExpr(), "1", "1"}
+	for _, c := range rollupColumns {
+		if c.kind != rollupAverage {
+			names = append(names, c.name)
+			exprs = append(exprs, c.aggregate(1))
+		}
+	}
+	_, err = tx.Exec(fmt.Sprintf("INSERT INTO %v (%v) SELECT %v FROM dashboard_data_v2 GROUP BY 1",
+		p.table, strings.Join(names, ", "), strings.Join(exprs, ", ")))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("UPDATE %v SET %v", p.table, averagesSet()))
+	return err
+}
+
+// updateRollups calls write, which changes the dashboard_data_v2 rows at the given heights in tx, and
+// keeps the rollups up to date: the rows are subtracted from their buckets before the write, and
+// whatever is stored at those heights afterwards is added back. The work depends on the number of rows,
+// not on the size of their buckets. Only calls write with -rollups=false.
+func updateRollups(tx pgExecer, heights []int64, write func() error) error {
+	if !ROLLUPS || len(heights) == 0 {
+		return write()
+	}
+
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock(?)`, ROLLUP_LOCK_ID)
+	if err != nil {
+		return err
+	}
+
+	touched := make([][]int64, len(rollupPeriods))
+	for i, p := range rollupPeriods {
+		touched[i], err = p.apply(tx, heights, -1)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = write()
+	if err != nil {
+		return err
+	}
+
+	for i, p := range rollupPeriods {
+		added, err := p.apply(tx, heights, 1)
+		if err != nil {
+			return err
+		}
+
+		err = p.updateBuckets(tx, append(touched[i], added...))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rowHeights returns the heights of rows, for updateRollups.
+func rowHeights(rows []DashboardDataV2) []int64 {
+	heights := make([]int64, len(rows))
+	for i, row := range rows {
+		heights[i] = row.Height
+	}
+	return heights
+}
+
+// A staleBucket is a bucket of a lazy period with changes since it was last recomputed.
+type staleBucket struct {
+	Bucket  int64
+	Changes int64
+}
+
+// refreshStaleRollups recomputes the min, max and percentile columns of lazy periods for buckets that were
+// written to since. Each bucket is recomputed on its own and without the rollup lock, so writers aren't held up.
+// A bucket written to while it is recomputed, or that can't be recomputed because Postgres is down,
+// stays stale until the next refresh.
+func refreshStaleRollups() {
+	if !USE_POSTGRES || !ROLLUPS {
+		return
+	}
+
+	for _, p := range rollupPeriods {
+		if !p.lazy {
+			continue
+		}
+
+		var stale []staleBucket
+		err := retry("PG select", func() error {
+			_, err := pgPool.Query(&stale, fmt.Sprintf("SELECT bucket, changes FROM %v WHERE recomputed_changes < changes ORDER BY bucket", p.table))
+			return err
+		})
+		if err != nil {
+			log.Printf("Error finding stale buckets of %v, trying again later: %v\n", p.table, err)
+			return
+		}
+
+		for _, s := range stale {
+			if stopRequested() {
+				return
+			}
+
+			startTime := time.Now()
+			err := retry("PG rollup", func() error {
+				_, err := pgPool.Exec(p.recomputeQuery("?"), s.Changes, s.Bucket, s.Bucket+p.size, pg.In([]int64{s.Bucket}))
+				return err
+			})
+			if err != nil {
+				log.Printf("Error refreshing bucket %v of %v, trying again later: %v\n", s.Bucket, p.table, err)
+				return
+			}
+
+			log.Printf("Refreshed bucket %v of %v in %v\n", s.Bucket, p.table, time.Since(startTime))
+		}
+	}
+}
+
+// keepRollupsFresh calls refreshStaleRollups every ROLLUP_REFRESH_INTERVAL until shutdown.
+func keepRollupsFresh() {
+	ticker := time.NewTicker(ROLLUP_REFRESH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopping:
+			return
+		case <-ticker.C:
+			refreshStaleRollups()
+		}
+	}
+}
+
+// rebuildRollups is the -rebuild-rollups command, which recomputes every rollup table from scratch,
+// e.g. after a backfill with -rollups=false.
+func rebuildRollups() {
+	if !USE_POSTGRES {
+		fatal("-rebuild-rollups needs Postgres")
+	}
+
+	for _, p := range rollupPeriods {
+		startTime := time.Now()
+
+		err := retry("PG rollup", func() error {
+			return pgPool.RunInTransaction(func(tx *pg.Tx) error {
+				_, err := tx.Exec(`SELECT pg_advisory_xact_lock(?)`, ROLLUP_LOCK_ID)
+				if err != nil {
+					return err
+				}
+				return p.rebuild(tx)
+			})
+		})
+		if err != nil {
+			fatal(fmt.Sprintf("Error rebuilding %v: ", p.table), err)
+		}
+
+		log.Printf("Rebuilt %v in %v\n", p.table, time.Since(startTime))
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+func TestRollupBuckets(t *testing.T) {
+	daily, weekly, epoch, halving := rollupPeriods[0], rollupPeriods[1], rollupPeriods[2], rollupPeriods[3]
+
+	tests := []struct {
+		period rollupPeriod
+		row    DashboardDataV2
+		want   int64
+	}{
+		// 2024-01-01 was a Monday.
+		{daily, DashboardDataV2{Time: 1704067200}, 1704067200},
+		{daily, DashboardDataV2{Time: 1704067200 + 86399}, 1704067200},
+		{daily, DashboardDataV2{Time: 1704067200 + 86400}, 1704067200 + 86400},
+		{weekly, DashboardDataV2{Time: 1704067200}, 1704067200},
+		{weekly, DashboardDataV2{Time: 1704067200 + 7*86400 - 1}, 1704067200},
+		{weekly, DashboardDataV2{Time: 1704067200 + 7*86400}, 1704067200 + 7*86400},
+		{weekly, DashboardDataV2{Time: 1704067200 - 1}, 1704067200 - 7*86400},
+		// The genesis block, on Saturday 2009-01-03, is in the week of Monday 2008-12-29.
+		{weekly, DashboardDataV2{Time: 1231006505}, 1230508800},
+		{epoch, DashboardDataV2{Height: 0}, 0},
+		{epoch, DashboardDataV2{Height: 2015}, 0},
+		{epoch, DashboardDataV2{Height: 2016*3 + 5}, 2016 * 3},
+		{halving, DashboardDataV2{Height: 209999}, 0},
+		{halving, DashboardDataV2{Height: 630000}, 630000},
+	}
+
+	for _, test := range tests {
+		if got := test.period.bucket(test.row); got != test.want {
+			t.Errorf("%v bucket of %+v = %v, want %v", test.period.table, test.row, got, test.want)
+		}
+	}
+}
+
+// recordingTx is a pgExecer that records what each query does, and returns bucket 0 from every insert.
+type recordingTx struct {
+	steps []string
+}
+
+func (tx *recordingTx) record(query interface{}) {
+	q := fmt.Sprint(query)
+	table := ""
+	for _, p := range rollupPeriods {
+		if strings.Contains(q, p.table+" ") {
+			table = " " + p.table
+		}
+	}
+
+	switch {
+	case strings.Contains(q, "pg_advisory_xact_lock"):
+		tx.steps = append(tx.steps, "lock")
+	case strings.HasPrefix(q, "INSERT") && strings.Contains(q, " -1 * sum("):
+		tx.steps = append(tx.steps, "subtract"+table)
+	case strings.HasPrefix(q, "INSERT") && strings.Contains(q, " 1 * sum("):
+		tx.steps = append(tx.steps, "add"+table)
+	case strings.HasPrefix(q, "DELETE"):
+		tx.steps = append(tx.steps, "delete empty"+table)
+	case strings.Contains(q, "recomputed_changes = "):
+		tx.steps = append(tx.steps, "recompute"+table)
+	case strings.HasPrefix(q, "UPDATE"):
+		tx.steps = append(tx.steps, "averages"+table)
+	default:
+		tx.steps = append(tx.steps, q)
+	}
+}
+
+func (tx *recordingTx) Exec(query interface{}, params ...interface{}) (orm.Result, error) {
+	tx.record(query)
+	return nil, nil
+}
+
+func (tx *recordingTx) Query(model, query interface{}, params ...interface{}) (orm.Result, error) {
+	tx.record(query)
+	if buckets, ok := model.(*pg.Ints); ok {
+		*buckets = append(*buckets, 0)
+	}
+	return nil, nil
+}
+
+func TestUpdateRollupsSubtractsWritesAndAdds(t *testing.T) {
+	saved := ROLLUPS
+	t.Cleanup(func() { ROLLUPS = saved })
+	ROLLUPS = true
+
+	tx := &recordingTx{}
+	err := updateRollups(tx, []int64{5, 6}, func() error {
+		tx.steps = append(tx.steps, "write")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"lock"}
+	for _, p := range rollupPeriods {
+		want = append(want, "subtract "+p.table)
+	}
+	want = append(want, "write")
+	for _, p := range rollupPeriods {
+		want = append(want, "add "+p.table, "delete empty "+p.table, "averages "+p.table)
+		if !p.lazy {
+			want = append(want, "recompute "+p.table)
+		}
+	}
+
+	if strings.Join(tx.steps, "\n") != strings.Join(want, "\n") {
+		t.Errorf("steps:\n%v\nwant:\n%v", strings.Join(tx.steps, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestUpdateRollupsOnlyWritesWithoutRollups(t *testing.T) {
+	saved := ROLLUPS
+	t.Cleanup(func() { ROLLUPS = saved })
+	ROLLUPS = false
+
+	tx := &recordingTx{}
+	err := updateRollups(tx, []int64{5, 6}, func() error {
+		tx.steps = append(tx.steps, "write")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tx.steps) != 1 || tx.steps[0] != "write" {
+		t.Errorf("steps: %v, want only the write", tx.steps)
+	}
+}
+
+func TestUpdateRollupsStopsIfWriteFails(t *testing.T) {
+	saved := ROLLUPS
+	t.Cleanup(func() { ROLLUPS = saved })
+	ROLLUPS = true
+
+	tx := &recordingTx{}
+	err := updateRollups(tx, []int64{5}, func() error {
+		return fmt.Errorf("duplicate key")
+	})
+	if err == nil || err.Error() != "duplicate key" {
+		t.Fatalf("error: %v, want the write's", err)
+	}
+
+	for _, step := range tx.steps {
+		if strings.HasPrefix(step, "add") {
+			t.Errorf("added rows after a failed write: %v", tx.steps)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+)
+
+// useRetrySettings makes retries quick, and restores the settings afterwards.
+func useRetrySettings(t *testing.T, attempts int) {
+	savedAttempts, savedBase, savedMax := MAX_ATTEMPTS, RETRY_BASE_DELAY, RETRY_MAX_DELAY
+	t.Cleanup(func() {
+		MAX_ATTEMPTS, RETRY_BASE_DELAY, RETRY_MAX_DELAY = savedAttempts, savedBase, savedMax
+	})
+
+	MAX_ATTEMPTS = attempts
+	RETRY_BASE_DELAY, RETRY_MAX_DELAY = time.Millisecond, 10*time.Millisecond
+}
+
+// failHeights makes getblockstats fail the first time it is called for some heights: with an error
+// object for those in withError, and without any response for those in missing.
+func failHeights(fake *fakeBitcoind, withError, missing []int64) {
+	var mu sync.Mutex
+	failed := make(map[int64]bool)
+
+	fake.call = func(method string, params []json.RawMessage) (interface{}, *btcjson.RPCError, bool) {
+		var height int64
+		json.Unmarshal(params[0], &height)
+
+		mu.Lock()
+		first := !failed[height]
+		failed[height] = true
+		mu.Unlock()
+
+		if first {
+			for _, h := range withError {
+				if h == height {
+					return nil, &btcjson.RPCError{Code: btcjson.ErrRPCInvalidParameter, Message: "Block not available (pruned data)"}, true
+				}
+			}
+			for _, h := range missing {
+				if h == height {
+					return nil, nil, false
+				}
+			}
+		}
+		return fakeBlockStats(height), nil, true
+	}
+}
+
+func TestGetBlockStatsBatch(t *testing.T) {
+	fake := newFakeBitcoind(t)
+	failHeights(fake, []int64{3}, []int64{5})
+
+	results, failed, err := batchClientPool.getBlockStatsBatch([]int64{1, 2, 3, 4, 5, 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, height := range []int64{1, 2, 4, 6} {
+		result, ok := results[height]
+		if !ok {
+			t.Errorf("no result for height %v", height)
+			continue
+		}
+		if want := fakeBlockStats(height); result.Height != height || result.Hash != want.Hash || result.Txs != want.Txs {
+			t.Errorf("result for height %v is %+v, want %+v", height, result, want)
+		}
+	}
+	if len(results) != 4 {
+		t.Errorf("got %v results, want 4", len(results))
+	}
+
+	if rpcErr, ok := failed[3].(*btcjson.RPCError); !ok || rpcErr.Code != btcjson.ErrRPCInvalidParameter {
+		t.Errorf("height 3 failed with %v, want its RPC error", failed[3])
+	}
+	if err := failed[5]; err == nil || !strings.Contains(err.Error(), "no response") {
+		t.Errorf("height 5 failed with %v, want a missing response", err)
+	}
+	if len(failed) != 2 {
+		t.Errorf("got %v failures, want 2: %v", len(failed), failed)
+	}
+}
+
+func TestGetBlockStatsBatchHTTPError(t *testing.T) {
+	fake := newFakeBitcoind(t)
+	fake.status = func(batch bool, heights []int64) int { return http.StatusServiceUnavailable }
+
+	results, failed, err := batchClientPool.getBlockStatsBatch([]int64{1, 2, 3})
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("got error %v, want the HTTP status", err)
+	}
+	if results != nil || failed != nil {
+		t.Errorf("got results %v and failures %v along with a failed batch", results, failed)
+	}
+}
+
+func TestGetBlockStatsRangeFallsBack(t *testing.T) {
+	useRetrySettings(t, 3)
+	savedBatchSize := RPC_BATCH_SIZE
+	t.Cleanup(func() { RPC_BATCH_SIZE = savedBatchSize })
+	RPC_BATCH_SIZE = 10
+
+	fake := newFakeBitcoind(t)
+	failHeights(fake, []int64{3}, []int64{5})
+
+	// The first batch is turned away as a whole, and retried.
+	var mu sync.Mutex
+	turnedAway := false
+	fake.status = func(batch bool, heights []int64) int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if batch && !turnedAway {
+			turnedAway = true
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}
+
+	worker := setupWorker()
+	stats := worker.getBlockStatsRange(1, 7)
+
+	heights := make([]int64, len(stats))
+	for i, s := range stats {
+		heights[i] = s.Height
+		if want := fakeBlockStats(s.Height); s.Hash != want.Hash {
+			t.Errorf("height %v has hash %v, want %v", s.Height, s.Hash, want.Hash)
+		}
+	}
+	if want := []int64{1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(heights, want) {
+		t.Errorf("got heights %v, want %v", heights, want)
+	}
+
+	batches, singles := fake.requests()
+	if len(batches) != 2 {
+		t.Errorf("got %v batches, want the failed one and its retry: %v", len(batches), batches)
+	}
+	if want := []int64{3, 5}; !reflect.DeepEqual(singles, want) {
+		t.Errorf("single calls for heights %v, want %v", singles, want)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const CHUNK_SIZE_DEFAULT = 500
+
+// A chunk is a small range of heights [start, end) that a backfill worker analyzes in one go.
+type chunk struct {
+	start, end int
+	source     chunkSource
+
+	// The backfill worker analyzing the chunk, -1 while it is queued.
+	worker int
+
+	// Used by localChunks.
+	progressFile string
+	created      time.Time
+
+	// Used by pgChunks, the backfill and the height the chunk originally started at.
+	backfill string
+	id       int64
+}
+
+// A chunkSource hands out chunks to backfill workers and keeps track of their progress.
+type chunkSource interface {
+	// next returns the next chunk to analyze, or false once there is no more work.
+	next() (*chunk, bool)
+	logProgress(c *chunk, last int)
+	finish(c *chunk)
+	// release gives up a chunk that was only partly analyzed, e.g. on shutdown.
+	release(c *chunk)
+	close()
+}
+
+// logProgress records that all heights in [start, last) of this chunk are stored.
+func (c *chunk) logProgress(last int) {
+	c.source.logProgress(c, last)
+}
+
+// finish marks a chunk as fully stored.
+func (c *chunk) finish() {
+	c.source.finish(c)
+}
+
+// release gives up a partly analyzed chunk, its recorded progress is kept.
+func (c *chunk) release() {
+	c.source.release(c)
+}
+
+// splitRanges splits the given ranges into ranges of at most CHUNK_SIZE heights.
+func splitRanges(ranges []heightRange) []heightRange {
+	split := make([]heightRange, 0)
+	for _, r := range ranges {
+		for start := r.Start; start < r.End; start += int64(CHUNK_SIZE) {
+			end := start + int64(CHUNK_SIZE)
+			if end > r.End {
+				end = r.End
+			}
+			split = append(split, heightRange{start, end})
+		}
+	}
+
+	return split
+}
+
+// localChunks is a chunkSource for a single process, chunks are kept on a channel
+// and each chunk has its own progress record in WORKER_PROGRESS_DIR until it is finished.
+// All records of a run share one lock file, which is held until the run is over,
+// so a -recovery running at the same time leaves them alone.
+type localChunks struct {
+	queue chan *chunk
+
+	lock     *os.File
+	lockName string
+	host     string
+
+	// Number of chunks whose progress records are still around.
+	unfinished int64
+}
+
+// newLocalChunks queues chunks for the given ranges. A progress record is written for every
+// chunk up front, so that chunks no worker got to yet are also picked up by -recovery.
+func newLocalChunks(ranges []heightRange) *localChunks {
+	runID := fmt.Sprintf("%v-%v", time.Now().Format("01-02:15:04"), os.Getpid())
+	split := splitRanges(ranges)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		fatal("Error getting hostname: ", err)
+	}
+
+	source := &localChunks{
+		queue:      make(chan *chunk, len(split)),
+		lockName:   fmt.Sprintf("chunk-%v.lock", runID),
+		host:       hostname,
+		unfinished: int64(len(split)),
+	}
+
+	source.lock, err = lockFile(fmt.Sprintf("%v/%v", WORKER_PROGRESS_DIR, source.lockName))
+	if err != nil {
+		fatal("Error locking progress records: ", err)
+	}
+
+	for _, r := range split {
+		c := &chunk{
+			start:        int(r.Start),
+			end:          int(r.End),
+			source:       source,
+			worker:       -1,
+			progressFile: fmt.Sprintf("%v/chunk-%v-%v-%v", WORKER_PROGRESS_DIR, runID, r.Start, r.End),
+			created:      time.Now(),
+		}
+		c.logProgress(c.start)
+		source.queue <- c
+	}
+	close(source.queue)
+
+	log.Printf("Queued %v chunks\n", len(split))
+
+	return source
+}
+
+func (source *localChunks) next() (*chunk, bool) {
+	c, ok := <-source.queue
+	return c, ok
+}
+
+func (source *localChunks) logProgress(c *chunk, last int) {
+	err := writeProgress(c.progressFile, progressRecord{
+		Version: PROGRESS_FORMAT_VERSION,
+		Start:   c.start,
+		Last:    last,
+		End:     c.end,
+		Worker:  c.worker,
+		Host:    source.host,
+		Pid:     os.Getpid(),
+		Lock:    source.lockName,
+		Created: c.created,
+		Updated: time.Now(),
+	})
+	if err != nil {
+		fatal("Error logging progress: ", err)
+	}
+}
+
+// close releases the lock, and removes the lock file once no records need it anymore.
+func (source *localChunks) close() {
+	unlockFile(source.lock, atomic.LoadInt64(&source.unfinished) == 0)
+}
+
+// release keeps the progress record of the chunk, so -recovery picks it up.
+func (source *localChunks) release(c *chunk) {}
+
+func (source *localChunks) finish(c *chunk) {
+	err := os.Remove(c.progressFile)
+	if err != nil {
+		log.Printf("Error removing %v: %v\n", c.progressFile, err)
+	}
+	atomic.AddInt64(&source.unfinished, -1)
+}
+
+// runBackfill analyzes every height in the given ranges.
+// The ranges are split into small chunks, and workers each take the next chunk as soon as
+// they are done fetching their previous one, leaving the rows to the pipeline's writer.
+// The number of workers starts at N_WORKERS and is adjusted between MIN_WORKERS and
+// MAX_WORKERS depending on how bitcoind keeps up.
+// With -distributed the chunks are shared with other processes through Postgres.
+func runBackfill(ranges []heightRange) {
+	backfillChunks(newChunkSource(ranges))
+}
+
+// newChunkSource splits the ranges into chunks and records them, locally or in Postgres with -distributed.
+func newChunkSource(ranges []heightRange) chunkSource {
+	if DISTRIBUTED {
+		return newPgChunks(ranges)
+	}
+	return newLocalChunks(ranges)
+}
+
+// backfillChunks runs a backfill of the chunks of source, see runBackfill, and closes source when done.
+func backfillChunks(source chunkSource) {
+	defer source.close()
+
+	// MAX_WORKERS workers are started, each with a chunk, but only as many requests as the limiter allows are in flight.
+	limiter := newConcurrencyLimiter(N_WORKERS, MIN_WORKERS, MAX_WORKERS)
+
+	log.Printf("Starting backfill with %v workers (between %v and %v)\n", limiter.current(), MIN_WORKERS, MAX_WORKERS)
+	p := newPipeline(source, limiter)
+	p.run()
+
+	if stopRequested() {
+		log.Printf("Backfill stopped after %v chunks and %v, progress is recorded for -recovery\n", p.chunksDone, time.Since(p.startTime))
+		return
+	}
+	log.Printf("Backfill of %v chunks done after %v\n", p.chunksDone, time.Since(p.startTime))
+
+	refreshStaleRollups()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useBackfillSettings sets the globals a backfill reads, and restores them afterwards.
+func useBackfillSettings(t *testing.T) {
+	saved := []interface{}{CHUNK_SIZE, RPC_BATCH_SIZE, N_WORKERS, MIN_WORKERS, MAX_WORKERS, MAX_ATTEMPTS, DISTRIBUTED, WORKER_PROGRESS_DIR}
+	t.Cleanup(func() {
+		CHUNK_SIZE, RPC_BATCH_SIZE = saved[0].(int), saved[1].(int)
+		N_WORKERS, MIN_WORKERS, MAX_WORKERS = saved[2].(int), saved[3].(int), saved[4].(int)
+		MAX_ATTEMPTS, DISTRIBUTED, WORKER_PROGRESS_DIR = saved[5].(int), saved[6].(bool), saved[7].(string)
+	})
+
+	CHUNK_SIZE = 100
+	RPC_BATCH_SIZE = 10
+	N_WORKERS, MIN_WORKERS, MAX_WORKERS = 2, 1, 2
+	MAX_ATTEMPTS = 1
+	DISTRIBUTED = false
+	WORKER_PROGRESS_DIR = t.TempDir()
+}
+
+func TestBackfillStopsCleanlyMidChunk(t *testing.T) {
+	useBackfillSettings(t)
+	resetStopping(t)
+	fake := newFakeBitcoind(t)
+	stored := useMemorySink(t)
+
+	// Stop once a few batches are fetched, in the middle of the first chunks.
+	var stop sync.Once
+	fake.status = func(batch bool, heights []int64) int {
+		batches, _ := fake.requests()
+		if len(batches) >= 3 {
+			stop.Do(func() { close(stopping) })
+		}
+		return 200
+	}
+
+	done := make(chan struct{})
+	go func() {
+		runBackfill([]heightRange{{0, 1000}})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("backfill didn't stop")
+	}
+
+	files, err := filepath.Glob(WORKER_PROGRESS_DIR + "/chunk-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := 0
+	for _, path := range files {
+		if filepath.Ext(path) == ".lock" {
+			// The run's lock must be released, so -recovery can take over.
+			lock, err := lockFile(path)
+			if err != nil {
+				t.Fatalf("lock %v still held after the backfill stopped: %v", path, err)
+			}
+			unlockFile(lock, false)
+			continue
+		}
+
+		record, err := readProgress(path)
+		if err != nil {
+			t.Fatalf("reading %v: %v", path, err)
+		}
+		records++
+
+		// Everything recorded as done must be stored.
+		for height := record.Start; height < record.Last; height++ {
+			if !stored.has(int64(height)) {
+				t.Errorf("height %v is recorded as done in %v but not stored", height, filepath.Base(path))
+			}
+		}
+	}
+
+	// The backfill stopped early, so the unfinished chunks must still be there for -recovery.
+	if records == 0 {
+		t.Fatal("no progress records left after stopping early")
+	}
+	if len(stored.blocks) >= 1000 {
+		t.Fatalf("stored all %v blocks, the backfill didn't stop early", len(stored.blocks))
+	}
+}
+
+func TestReleaseKeepsLocalProgress(t *testing.T) {
+	useBackfillSettings(t)
+
+	source := newLocalChunks([]heightRange{{0, 100}})
+	c, ok := source.next()
+	if !ok {
+		t.Fatal("no chunk queued")
+	}
+
+	c.logProgress(40)
+	c.release()
+	source.close()
+
+	record, err := readProgress(c.progressFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Start != 0 || record.Last != 40 || record.End != 100 {
+		t.Errorf("record after release = [%v, %v, %v), want [0, 40, 100)", record.Start, record.Last, record.End)
+	}
+
+	contents, err := ioutil.ReadFile(c.progressFile)
+	if err != nil || len(contents) == 0 {
+		t.Errorf("progress file missing after release: %v", err)
+	}
+}
+
+// resetStopping gives the next test a fresh shutdown channel.
+func resetStopping(t *testing.T) {
+	stopping = make(chan struct{})
+	t.Cleanup(func() { stopping = make(chan struct{}) })
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// stopping is closed on the first SIGINT or SIGTERM. Block modes stop taking on new heights,
+// store what they already have and record their progress, so nothing is lost or analyzed twice.
+var stopping = make(chan struct{})
+
+// handleSignals starts listening for SIGINT and SIGTERM.
+// The first signal closes stopping, a second one exits immediately.
+func handleSignals() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %v, storing pending blocks before exiting. Send it again to exit immediately.\n", sig)
+		close(stopping)
+
+		sig = <-sigs
+		log.Printf("Received %v again, exiting immediately\n", sig)
+		os.Exit(1)
+	}()
+}
+
+// stopRequested returns true once a shutdown signal was received.
+func stopRequested() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const CSV_DIR_DEFAULT = "./csv"
+
+// csvSink appends blocks to blocks.csv and mempool data points to mempool.csv in a directory.
+// Columns are named like the JSON backup fields, arrays are written as JSON.
+// CSV files are only ever appended to, and -on-conflict doesn't apply: a height that is stored again
+// (e.g. after a reorg, or by a second backfill over the same range) shows up twice, and the last row
+// for a height is the one that counts.
+type csvSink struct {
+	mu      sync.Mutex
+	blocks  *csvFile
+	mempool *csvFile
+}
+
+// A csvFile is one CSV file that is appended to.
+type csvFile struct {
+	file   *os.File
+	writer *csv.Writer
+}
+
+func newCSVSink(dir string) *csvSink {
+	createDirIfNotExist(dir)
+
+	sink := &csvSink{
+		blocks:  openCSVFile(dir+"/blocks.csv", append([]string{"version"}, csvHeader(reflect.TypeOf(DashboardDataV2{}))...)),
+		mempool: openCSVFile(dir+"/mempool.csv", csvHeader(reflect.TypeOf(MempoolData{}))),
+	}
+	log.Printf("Writing CSV files to %v\n", dir)
+
+	return sink
+}
+
+// openCSVFile opens a CSV file for appending, and writes the header if the file is new.
+func openCSVFile(path string, header []string) *csvFile {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		fatal("Error opening CSV file: ", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		fatal("Error opening CSV file: ", err)
+	}
+
+	f := &csvFile{file: file, writer: csv.NewWriter(file)}
+	if info.Size() == 0 {
+		f.writer.Write(header)
+		f.writer.Flush()
+		if err := f.writer.Error(); err != nil {
+			fatal("Error writing CSV header: ", err)
+		}
+	}
+
+	return f
+}
+
+// csvHeader returns the column names for a row type, named after the JSON fields.
+func csvHeader(t reflect.Type) []string {
+	header := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		header = append(header, name)
+	}
+
+	return header
+}
+
+// csvRecord returns the values of a row in the order of csvHeader.
+func csvRecord(v interface{}) []string {
+	val := reflect.ValueOf(v)
+	t := val.Type()
+
+	record := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("json"), ",")[0] == "-" {
+			continue
+		}
+
+		field := val.Field(i)
+		if field.Kind() == reflect.Slice {
+			encoded, _ := json.Marshal(field.Interface())
+			record = append(record, string(encoded))
+			continue
+		}
+		record = append(record, fmt.Sprint(field.Interface()))
+	}
+
+	return record
+}
+
+func (s *csvSink) name() string { return SINK_CSV }
+
+func (s *csvSink) writeBlocks(batch []Data) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, data := range batch {
+		record := append([]string{fmt.Sprint(data.Version)}, csvRecord(data.DashboardDataRow)...)
+		s.blocks.writer.Write(record)
+	}
+	s.blocks.writer.Flush()
+
+	return s.blocks.writer.Error()
+}
+
+func (s *csvSink) writeMempool(data MempoolData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mempool.writer.Write(csvRecord(data))
+	s.mempool.writer.Flush()
+
+	return s.mempool.writer.Error()
+}
+
+// rollback can't remove rows from an append-only file, the rows for the new branch are appended later.
+func (s *csvSink) rollback(fork, end int64) error {
+	log.Printf("CSV files keep the reorged blocks in (%v, %v), later rows for those heights replace them\n", fork, end)
+	return nil
+}
+
+func (s *csvSink) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blocks.file.Close()
+	s.mempool.file.Close()
+}
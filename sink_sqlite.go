@@ -0,0 +1,110 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// This build has the SQLite sink, see sink_sqlite_disabled.go.
+const SQLITE_SUPPORTED = true
+
+// sqliteSink writes to an embedded SQLite database, e.g. for running without Postgres on a laptop.
+// Rows are stored as the same JSON as the backups, next to a few columns to look them up by.
+// SQLite's JSON functions can get at the rest, e.g. json_extract(data, '$.num_txs').
+type sqliteSink struct {
+	db *sql.DB
+}
+
+func newSQLiteSink(path string) *sqliteSink {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		fatal("Error opening SQLite database: ", err)
+	}
+
+	// SQLite allows one writer at a time anyway.
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS dashboard_data (
+			height  INTEGER PRIMARY KEY,
+			hash    TEXT NOT NULL,
+			time    INTEGER NOT NULL,
+			version INTEGER NOT NULL,
+			data    TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS mempool_data (
+			time INTEGER PRIMARY KEY,
+			data TEXT NOT NULL
+		)`,
+	} {
+		_, err := db.Exec(stmt)
+		if err != nil {
+			fatal("Error creating SQLite table: ", err)
+		}
+	}
+	log.Printf("Writing to SQLite database %v\n", path)
+
+	return &sqliteSink{db: db}
+}
+
+func (s *sqliteSink) name() string { return SINK_SQLITE }
+
+// writeBlocks inserts the batch in one transaction, with the same -on-conflict rules as Postgres.
+func (s *sqliteSink) writeBlocks(batch []Data) error {
+	query := `INSERT INTO dashboard_data (height, hash, time, version, data) VALUES (?, ?, ?, ?, ?)`
+	switch ON_CONFLICT {
+	case ON_CONFLICT_SKIP:
+		query += ` ON CONFLICT (height) DO NOTHING`
+	case ON_CONFLICT_OVERWRITE:
+		query += ` ON CONFLICT (height) DO UPDATE
+			SET hash = excluded.hash, time = excluded.time, version = excluded.version, data = excluded.data
+			WHERE dashboard_data.version < excluded.version`
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, data := range batch {
+		row := data.DashboardDataRow
+		encoded, err := json.Marshal(row)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		_, err = tx.Exec(query, row.Height, row.Hash, row.Time, data.Version, string(encoded))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteSink) writeMempool(data MempoolData) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO mempool_data (time, data) VALUES (?, ?)`, data.Time, string(encoded))
+	return err
+}
+
+func (s *sqliteSink) rollback(fork, end int64) error {
+	_, err := s.db.Exec(`DELETE FROM dashboard_data WHERE height > ? AND height < ?`, fork, end)
+	return err
+}
+
+func (s *sqliteSink) close() {
+	s.db.Close()
+}
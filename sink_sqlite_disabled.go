@@ -0,0 +1,13 @@
+//go:build !sqlite
+// +build !sqlite
+
+package main
+
+// The SQLite sink needs cgo, so it is only built with -tags sqlite, see sink_sqlite.go.
+const SQLITE_SUPPORTED = false
+
+// newSQLiteSink is never called, parseSinks turns down the sqlite sink in this build.
+func newSQLiteSink(path string) sink {
+	fatal("Built without SQLite support, rebuild with -tags sqlite")
+	return nil
+}
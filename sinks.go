@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/go-pg/pg"
+)
+
+// Names of the sinks that can be combined with -sinks.
+const (
+	SINK_POSTGRES = "postgres"
+	SINK_JSON     = "json"
+	SINK_SQLITE   = "sqlite"
+	SINK_CSV      = "csv"
+)
+
+const SQLITE_PATH_DEFAULT = "./dashboard.sqlite"
+
+// A sink stores the rows computed by the block and mempool analyses.
+// Every row is written to all sinks in use, and sinks must be safe for concurrent use.
+type sink interface {
+	name() string
+
+	// writeBlocks stores a batch of blocks. Heights that are already stored are handled according to -on-conflict,
+	// except by sinks that can't tell, see csvSink.
+	writeBlocks(batch []Data) error
+	writeMempool(data MempoolData) error
+
+	// rollback removes the blocks in (fork, end) after they were reorged out of the best chain.
+	rollback(fork, end int64) error
+
+	close()
+}
+
+var sinks []sink
+
+// parseSinks turns the -sinks list into sink names. Without a list, the sinks
+// are the ones selected with -postgres and -json, as before there were sinks.
+func parseSinks(list string, usePostgres, useJSON bool) ([]string, error) {
+	if list == "" {
+		names := make([]string, 0)
+		if usePostgres {
+			names = append(names, SINK_POSTGRES)
+		}
+		if useJSON {
+			names = append(names, SINK_JSON)
+		}
+		return names, nil
+	}
+
+	names := make([]string, 0)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case SINK_SQLITE:
+			if !SQLITE_SUPPORTED {
+				return nil, fmt.Errorf("the sqlite sink isn't part of this build, rebuild with -tags sqlite")
+			}
+			names = append(names, name)
+		case SINK_POSTGRES, SINK_JSON, SINK_CSV:
+			names = append(names, name)
+		default:
+			return nil, fmt.Errorf("unknown sink %q in -sinks, expected %v, %v, %v or %v", name, SINK_POSTGRES, SINK_JSON, SINK_SQLITE, SINK_CSV)
+		}
+	}
+
+	return names, nil
+}
+
+// setupSinks opens the sinks with the given names. Needs the pools to be set up already.
+// The json sink only writes mempool data if it was listed in -sinks, -json alone keeps it to block backups.
+func setupSinks(names []string, listed bool) {
+	for _, name := range names {
+		switch name {
+		case SINK_POSTGRES:
+			sinks = append(sinks, &postgresSink{db: pgPool})
+		case SINK_JSON:
+			sinks = append(sinks, &jsonSink{mempool: listed})
+		case SINK_SQLITE:
+			sinks = append(sinks, newSQLiteSink(SQLITE_PATH))
+		case SINK_CSV:
+			sinks = append(sinks, newCSVSink(CSV_DIR))
+		}
+	}
+}
+
+func closeSinks() {
+	for _, s := range sinks {
+		s.close()
+	}
+}
+
+// writeBlocks writes a batch of blocks to every sink.
+func writeBlocks(batch []Data) {
+	for _, s := range sinks {
+		err := s.writeBlocks(batch)
+		if err != nil {
+			fatal(fmt.Sprintf("Error writing %v blocks to %v: ", len(batch), s.name()), err)
+		}
+	}
+}
+
+// writeMempool writes a mempool data point to every sink.
+func writeMempool(data MempoolData) {
+	for _, s := range sinks {
+		err := s.writeMempool(data)
+		if err != nil {
+			fatal(fmt.Sprintf("Error writing mempool data to %v: ", s.name()), err)
+		}
+	}
+}
+
+// rollbackBlocks removes the blocks in (fork, end) from every sink.
+func rollbackBlocks(fork, end int64) {
+	for _, s := range sinks {
+		err := s.rollback(fork, end)
+		if err != nil {
+			fatal(fmt.Sprintf("Error rolling back reorged blocks in %v: ", s.name()), err)
+		}
+	}
+}
+
+// postgresSink writes to the dashboard_data_v2 and mempool_data tables.
+// Rows that can't be written because Postgres is unreachable go to the spool.
+type postgresSink struct {
+	db *pg.DB
+}
+
+func (s *postgresSink) name() string { return SINK_POSTGRES }
+
+func (s *postgresSink) writeBlocks(batch []Data) error {
+	rows := make([]DashboardDataV2, len(batch))
+	for i, data := range batch {
+		rows[i] = data.DashboardDataRow
+		rows[i].Version = data.Version
+	}
+
+	var written int
+	err := retry("PG insert", func() (err error) {
+		if len(rows) >= COPY_MIN_ROWS {
+			written, err = copyRows(s.db, rows)
+		} else {
+			written, err = upsertRows(s.db, rows)
+		}
+		return err
+	})
+	if err != nil {
+		if !isTransient(err) {
+			return err
+		}
+
+		// Postgres is unreachable, keep the rows until the replayer gets them in.
+		log.Printf("PG insert failed, spooling %v rows: %v\n", len(batch), err)
+		for _, data := range batch {
+			spoolData(data)
+		}
+		return nil
+	}
+
+	if written < len(rows) {
+		log.Printf("%v of %v rows were already stored (-on-conflict=%v)\n", len(rows)-written, len(rows), ON_CONFLICT)
+	}
+	log.Printf("\n\n STORED INTO POSTGRESQL \n\n")
+
+	return nil
+}
+
+func (s *postgresSink) writeMempool(data MempoolData) error {
+	return retry("PG insert", func() error {
+		return s.db.Insert(&data)
+	})
+}
+
+// rollback keeps the reorged rows in the stale_blocks table.
+func (s *postgresSink) rollback(fork, end int64) error {
+	worker := setupWorker()
+	worker.moveToStaleBlocks(fork, end)
+	return nil
+}
+
+// close does nothing, the connection pool outlives the sink.
+func (s *postgresSink) close() {}
+
+// jsonSink writes one file per block to JSON_DIR, and if mempool is set, one file per mempool data point to JSON_DIR/mempool.
+type jsonSink struct {
+	mempool bool
+}
+
+func (s *jsonSink) name() string { return SINK_JSON }
+
+// writeBlocks follows -on-conflict like Postgres does: skip keeps the file that is there, overwrite
+// replaces it if it was written by an older version (or can't be read), and error fails.
+func (s *jsonSink) writeBlocks(batch []Data) error {
+	for _, data := range batch {
+		path := fmt.Sprintf("%v/%v.json", JSON_DIR, data.DashboardDataRow.Height)
+		if _, err := os.Stat(path); err == nil {
+			switch ON_CONFLICT {
+			case ON_CONFLICT_SKIP:
+				continue
+			case ON_CONFLICT_ERROR:
+				return fmt.Errorf("height %v is already backed up in %v", data.DashboardDataRow.Height, path)
+			case ON_CONFLICT_OVERWRITE:
+				stored, err := decodeDataFile(path)
+				if err == nil && stored.Version >= data.Version {
+					continue
+				}
+			}
+		}
+
+		storeDataAsFile(data)
+	}
+	return nil
+}
+
+func (s *jsonSink) writeMempool(data MempoolData) error {
+	if !s.mempool {
+		return nil
+	}
+
+	dir := JSON_DIR + "/mempool"
+	createDirIfNotExist(dir)
+
+	file, err := os.Create(fmt.Sprintf("%v/%v.json", dir, data.Time))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewEncoder(file).Encode(data)
+}
+
+func (s *jsonSink) rollback(fork, end int64) error {
+	for height := fork + 1; height < end; height++ {
+		err := os.Remove(fmt.Sprintf("%v/%v.json", JSON_DIR, height))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jsonSink) close() {}
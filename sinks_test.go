@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseSinks(t *testing.T) {
+	// The sqlite sink is only there in builds with -tags sqlite.
+	sqliteErr := ""
+	if !SQLITE_SUPPORTED {
+		sqliteErr = "rebuild with -tags sqlite"
+	}
+
+	tests := []struct {
+		list                 string
+		usePostgres, useJSON bool
+		want                 []string
+		err                  string
+	}{
+		{"", true, true, []string{SINK_POSTGRES, SINK_JSON}, ""},
+		{"", true, false, []string{SINK_POSTGRES}, ""},
+		{"", false, false, []string{}, ""},
+		{"json, csv", true, false, []string{SINK_JSON, SINK_CSV}, ""},
+		{"postgres,mysql", true, true, nil, `unknown sink "mysql"`},
+		{"json,sqlite", false, false, []string{SINK_JSON, SINK_SQLITE}, sqliteErr},
+	}
+
+	for _, test := range tests {
+		names, err := parseSinks(test.list, test.usePostgres, test.useJSON)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("parseSinks(%q) error = %v, want %q", test.list, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSinks(%q): %v", test.list, err)
+			continue
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("parseSinks(%q) = %v, want %v", test.list, names, test.want)
+		}
+	}
+}
+
+func TestJSONSinkWritesMempoolOnlyIfListed(t *testing.T) {
+	savedJSONDir := JSON_DIR
+	t.Cleanup(func() {
+		JSON_DIR = savedJSONDir
+		sinks = nil
+	})
+
+	for _, listed := range []bool{false, true} {
+		JSON_DIR = t.TempDir()
+		sinks = nil
+		setupSinks([]string{SINK_JSON}, listed)
+
+		writeMempool(MempoolData{Time: 1600000000})
+
+		_, err := os.Stat(JSON_DIR + "/mempool/1600000000.json")
+		if listed && err != nil {
+			t.Errorf("no mempool file with json in -sinks: %v", err)
+		}
+		if !listed && !os.IsNotExist(err) {
+			t.Errorf("mempool file written by -json alone (%v)", err)
+		}
+	}
+}
+
+func TestJSONSinkFollowsOnConflict(t *testing.T) {
+	savedJSONDir, savedOnConflict := JSON_DIR, ON_CONFLICT
+	t.Cleanup(func() { JSON_DIR, ON_CONFLICT = savedJSONDir, savedOnConflict })
+
+	stored := Data{CURRENT_VERSION_NUMBER - 1, DashboardDataV2{Height: 5, Hash: "stored"}}
+	newer := Data{CURRENT_VERSION_NUMBER, DashboardDataV2{Height: 5, Hash: "newer"}}
+	older := Data{CURRENT_VERSION_NUMBER - 2, DashboardDataV2{Height: 5, Hash: "older"}}
+
+	tests := []struct {
+		onConflict string
+		write      Data
+		wantHash   string
+		wantErr    bool
+	}{
+		{ON_CONFLICT_SKIP, newer, "stored", false},
+		{ON_CONFLICT_OVERWRITE, newer, "newer", false},
+		{ON_CONFLICT_OVERWRITE, older, "stored", false},
+		{ON_CONFLICT_ERROR, newer, "stored", true},
+	}
+
+	for _, test := range tests {
+		JSON_DIR = t.TempDir()
+		ON_CONFLICT = test.onConflict
+		storeDataAsFile(stored)
+
+		s := &jsonSink{}
+		err := s.writeBlocks([]Data{test.write, {CURRENT_VERSION_NUMBER, DashboardDataV2{Height: 6, Hash: "new"}}})
+		if (err != nil) != test.wantErr {
+			t.Errorf("-on-conflict=%v writing version %v: error %v", test.onConflict, test.write.Version, err)
+		}
+
+		data, ok := readDataFile(5)
+		if !ok || data.DashboardDataRow.Hash != test.wantHash {
+			t.Errorf("-on-conflict=%v writing version %v: stored %q, want %q", test.onConflict, test.write.Version, data.DashboardDataRow.Hash, test.wantHash)
+		}
+
+		// Heights that aren't stored yet are written in every mode, unless an earlier one failed.
+		if _, ok := readDataFile(6); ok == test.wantErr {
+			t.Errorf("-on-conflict=%v: height 6 written = %v", test.onConflict, ok)
+		}
+	}
+}
+
+// memorySink is a sink that keeps blocks in memory.
+type memorySink struct {
+	mu     sync.Mutex
+	blocks map[int64]Data
+}
+
+func useMemorySink(t *testing.T) *memorySink {
+	s := &memorySink{blocks: make(map[int64]Data)}
+	sinks = []sink{s}
+	t.Cleanup(func() { sinks = nil })
+	return s
+}
+
+func (s *memorySink) name() string { return "memory" }
+
+func (s *memorySink) writeBlocks(batch []Data) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, data := range batch {
+		s.blocks[data.DashboardDataRow.Height] = data
+	}
+	return nil
+}
+
+func (s *memorySink) writeMempool(data MempoolData) error { return nil }
+
+func (s *memorySink) rollback(fork, end int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for height := fork + 1; height < end; height++ {
+		delete(s.blocks, height)
+	}
+	return nil
+}
+
+func (s *memorySink) close() {}
+
+func (s *memorySink) has(height int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.blocks[height]
+	return ok
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SPOOL_DIR_RELATIVE = "/spool"
+
+// How often the spool is checked for rows to replay.
+const SPOOL_REPLAY_INTERVAL = 30 * time.Second
+
+// Rows that can't be written to Postgres, e.g. during maintenance, are kept in SPOOL_DIR
+// as one file per height in the same format as the JSON backups, until the replayer
+// gets them into Postgres. The number of spooled rows is published as spool_depth.
+var SPOOL_DIR string
+
+func init() {
+	expvar.Publish("spool_depth", expvar.Func(func() interface{} {
+		return len(spooledHeights())
+	}))
+}
+
+// spoolData durably stores a row that couldn't be written to Postgres.
+// The file is synced and renamed into place, so the replayer never sees half a row.
+func spoolData(data Data) {
+	path := fmt.Sprintf("%v/%v.json", SPOOL_DIR, data.DashboardDataRow.Height)
+	tmpPath := path + ".tmp"
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		fatal("Error creating spool file: ", err)
+	}
+
+	err = json.NewEncoder(file).Encode(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		fatal("Error spooling row: ", err)
+	}
+}
+
+// spooledHeights returns the heights of all spooled rows, in ascending order.
+func spooledHeights() []int64 {
+	files, err := ioutil.ReadDir(SPOOL_DIR)
+	if err != nil {
+		return nil
+	}
+
+	heights := make([]int64, 0, len(files))
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		height, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		heights = append(heights, height)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+
+	return heights
+}
+
+// startSpoolReplayer drains the spool in the background for as long as the process runs.
+func startSpoolReplayer() {
+	go func() {
+		for {
+			replaySpool()
+
+			select {
+			case <-stopping:
+				return
+			case <-time.After(SPOOL_REPLAY_INTERVAL):
+			}
+		}
+	}()
+}
+
+// replaySpool inserts spooled rows into Postgres in height order, removing each one once it is stored.
+// It gives up for now at the first transient error, since Postgres is probably still unreachable.
+func replaySpool() {
+	heights := spooledHeights()
+	if len(heights) == 0 {
+		return
+	}
+	log.Printf("Replaying %v spooled rows\n", len(heights))
+
+	replayed := 0
+	for _, height := range heights {
+		path := fmt.Sprintf("%v/%v.json", SPOOL_DIR, height)
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("Error reading spooled row %v: %v\n", path, err)
+			continue
+		}
+
+		var data Data
+		err = json.Unmarshal(contents, &data)
+		if err != nil {
+			log.Printf("Error decoding spooled row %v: %v\n", path, err)
+			continue
+		}
+		data.DashboardDataRow.Version = data.Version
+
+		_, err = upsertRows(pgPool, []DashboardDataV2{data.DashboardDataRow})
+		if err != nil && isTransient(err) {
+			log.Printf("Postgres still unavailable, %v spooled rows left: %v\n", len(heights)-replayed, err)
+			return
+		}
+		if err != nil {
+			log.Printf("Error replaying spooled row at height %v, leaving it in the spool: %v\n", height, err)
+			continue
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			fatal("Error removing spooled row: ", err)
+		}
+		replayed++
+	}
+
+	log.Printf("Replayed %v spooled rows, %v left\n", replayed, len(heights)-replayed)
+}
+
+// serveMetrics serves expvar's /debug/vars, which includes spool_depth, on the given address.
+func serveMetrics(addr string) {
+	go func() {
+		err := http.ListenAndServe(addr, nil)
+		if err != nil {
+			log.Println("Error serving metrics: ", err)
+		}
+	}()
+	log.Printf("Serving metrics at http://%v/debug/vars\n", addr)
+}
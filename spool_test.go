@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// useSpool points SPOOL_DIR at a new directory.
+func useSpool(t *testing.T) {
+	saved := SPOOL_DIR
+	t.Cleanup(func() { SPOOL_DIR = saved })
+	SPOOL_DIR = t.TempDir()
+}
+
+func TestSpoolData(t *testing.T) {
+	useSpool(t)
+
+	for _, height := range []int64{12, 3, 7} {
+		spoolData(Data{CURRENT_VERSION_NUMBER, DashboardDataV2{Height: height, Hash: fmt.Sprint("block ", height)}})
+	}
+	// Left over by a crash while spooling.
+	if err := ioutil.WriteFile(SPOOL_DIR+"/5.json.tmp", []byte("{"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if heights := spooledHeights(); !reflect.DeepEqual(heights, []int64{3, 7, 12}) {
+		t.Errorf("spooled heights %v, want [3 7 12]", heights)
+	}
+
+	data, err := decodeDataFile(SPOOL_DIR + "/7.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Version != CURRENT_VERSION_NUMBER || data.DashboardDataRow.Hash != "block 7" {
+		t.Errorf("spooled row %+v", data)
+	}
+}
+
+func TestSpoolReplayRoundTrip(t *testing.T) {
+	newFakeBitcoind(t)
+	usePostgres(t)
+	useSpool(t)
+	worker := setupWorker()
+
+	savedRollups, savedOnConflict, savedPostgres := ROLLUPS, ON_CONFLICT, USE_POSTGRES
+	t.Cleanup(func() { ROLLUPS, ON_CONFLICT, USE_POSTGRES = savedRollups, savedOnConflict, savedPostgres })
+	ROLLUPS, ON_CONFLICT, USE_POSTGRES = false, ON_CONFLICT_SKIP, true
+
+	// Far above any real height, so the scratch database can hold other rows too.
+	const base = 910000000
+	clear := func() {
+		_, err := pgPool.Exec(`DELETE FROM dashboard_data_v2 WHERE height >= ? AND height < ?`, base, base+10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	clear()
+	t.Cleanup(clear)
+
+	_, err := upsertRows(pgPool, []DashboardDataV2{storableRow(base, "stored", CURRENT_VERSION_NUMBER), storableRow(base+3, "stored", CURRENT_VERSION_NUMBER)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spoolData(Data{CURRENT_VERSION_NUMBER, storableRow(base+1, "spooled", CURRENT_VERSION_NUMBER)})
+	spoolData(Data{CURRENT_VERSION_NUMBER, storableRow(base+2, "spooled", CURRENT_VERSION_NUMBER)})
+
+	if gaps := worker.findGaps(base, base+5); !reflect.DeepEqual(gaps, []heightRange{{base + 4, base + 5}}) {
+		t.Errorf("gaps with rows in the spool: %v, want [{%v %v}]", gaps, base+4, base+5)
+	}
+
+	replaySpool()
+
+	if heights := spooledHeights(); len(heights) != 0 {
+		t.Errorf("still spooled after replaying: %v", heights)
+	}
+	var hashes []string
+	_, err = pgPool.Query(&hashes, `SELECT hash FROM dashboard_data_v2 WHERE height >= ? AND height < ? ORDER BY height`, base, base+4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hashes, []string{"stored", "spooled", "spooled", "stored"}) {
+		t.Errorf("stored hashes after replaying: %v", hashes)
+	}
+	if gaps := worker.findGaps(base, base+5); !reflect.DeepEqual(gaps, []heightRange{{base + 4, base + 5}}) {
+		t.Errorf("gaps after replaying: %v, want [{%v %v}]", gaps, base+4, base+5)
+	}
+}
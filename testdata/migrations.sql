@@ -0,0 +1,159 @@
+-- 1: create dashboard_data_v2, stale_blocks and mempool_data
+CREATE TABLE IF NOT EXISTS dashboard_data_v2 (
+  id bigserial NOT NULL,
+  avg_fee bigint NOT NULL,
+  avg_fee_rate bigint NOT NULL,
+  avg_tx_size bigint NOT NULL,
+  hash text NOT NULL,
+  height bigint NOT NULL,
+  num_inputs bigint NOT NULL,
+  max_fee bigint NOT NULL,
+  max_fee_rate bigint NOT NULL,
+  max_tx_size bigint NOT NULL,
+  median_fee bigint NOT NULL,
+  median_time bigint,
+  median_tx_size bigint NOT NULL,
+  min_fee bigint NOT NULL,
+  min_fee_rate bigint NOT NULL,
+  min_tx_size bigint NOT NULL,
+  feerate_percentiles bigint[] NOT NULL,
+  num_outputs bigint NOT NULL,
+  subsidy bigint NOT NULL,
+  segwit_total_size bigint NOT NULL,
+  segwit_total_weight bigint NOT NULL,
+  num_segwit_txs bigint NOT NULL,
+  time bigint NOT NULL,
+  total_amount_out bigint NOT NULL,
+  total_block_size bigint NOT NULL,
+  total_weight bigint NOT NULL,
+  total_fee bigint NOT NULL,
+  num_txs bigint NOT NULL,
+  utxo_increase bigint NOT NULL,
+  utxo_size_increase bigint NOT NULL,
+  nested_p2wpkh_outputs_spent bigint NOT NULL,
+  nested_p2wsh_outputs_spent bigint NOT NULL,
+  native_p2wpkh_outputs_spent bigint NOT NULL,
+  native_p2wsh_outputs_spent bigint NOT NULL,
+  txs_spending_nested_p2wpkh_outputs bigint NOT NULL,
+  txs_spending_nested_p2wsh_outputs bigint NOT NULL,
+  txs_spending_native_p2wpkh_outputs bigint NOT NULL,
+  txs_spending_native_p2wsh_outputs bigint NOT NULL,
+  value_of_nested_p2wpkh_outputs_spent bigint NOT NULL,
+  value_of_nested_p2wsh_outputs_spent bigint NOT NULL,
+  value_of_native_p2wpkh_outputs_spent bigint NOT NULL,
+  value_of_native_p2wsh_outputs_spent bigint NOT NULL,
+  value_of_native_p2wpkh_outputs_created bigint NOT NULL,
+  value_of_native_p2wsh_outputs_created bigint NOT NULL,
+  new_p2wpkh_outputs bigint NOT NULL,
+  new_p2wsh_outputs bigint NOT NULL,
+  txs_creating_p2wpkh bigint NOT NULL,
+  txs_creating_p2wsh bigint NOT NULL,
+  txs_signalling_opt_in_rbf bigint NOT NULL,
+  consolidating_txs bigint NOT NULL,
+  outputs_consolidated bigint NOT NULL,
+  batching_txs bigint NOT NULL,
+  txs_by_output_count bigint[] NOT NULL,
+  dust_output_count bigint[] NOT NULL,
+  mto_consolidations bigint NOT NULL,
+  mto_output_count bigint NOT NULL,
+  mto_total_value bigint NOT NULL,
+  num_txs_creating_native_segwit_outputs bigint NOT NULL,
+  txs_spending_native_sw_outputs bigint NOT NULL,
+  txs_spending_nested_sw_outputs bigint NOT NULL,
+  percent_inputs_consolidated double precision NOT NULL,
+  percent_new_outs_p2wpkh_outputs double precision NOT NULL,
+  percent_new_outs_p2wsh_outputs double precision NOT NULL,
+  percent_txs_by_output_count double precision[] NOT NULL,
+  dust_output_percentages double precision[] NOT NULL,
+  percent_of_inputs_spending_p2wpkh_outputs double precision NOT NULL,
+  percent_of_inputs_spending_p2wsh_outputs double precision NOT NULL,
+  percent_of_inputs_spending_native_p2wpkh_outputs double precision NOT NULL,
+  percent_of_inputs_spending_native_p2wsh_outputs double precision NOT NULL,
+  percent_of_inputs_spending_native_sw_outputs double precision NOT NULL,
+  percent_of_inputs_spending_nested_sw_outputs double precision NOT NULL,
+  percent_of_inputs_spending_nested_p2wpkh_output double precision NOT NULL,
+  percent_of_inputs_spending_nested_p2wsh_outputs double precision NOT NULL,
+  percent_txs_spending_p2wpkh_outputs double precision NOT NULL,
+  percent_txs_spending_p2wsh_outputs double precision NOT NULL,
+  percent_txs_spending_native_p2wpkh_outputs double precision NOT NULL,
+  percent_txs_spending_native_p2wsh_outputs double precision NOT NULL,
+  percent_txs_spending_native_segwit_outputs double precision NOT NULL,
+  percent_txs_spending_nested_segwit_outputs double precision NOT NULL,
+  percent_txs_spending_nested_p2wpkh_outputs double precision NOT NULL,
+  percent_txs_spending_nested_p2wsh_outputs double precision NOT NULL,
+  percent_txs_creating_p2wpkh_outputs double precision NOT NULL,
+  percent_txs_creating_p2wsh_outputs double precision NOT NULL,
+  percent_txs_creating_native_segwit_outputs double precision NOT NULL,
+  percent_sw_txs_that_are_native_sw double precision NOT NULL,
+  percent_txs_that_are_segwit_txs double precision NOT NULL,
+  percent_txs_signalling_opt_in_rbf double precision NOT NULL,
+  percent_txs_consolidating double precision NOT NULL,
+  percent_txs_batching double precision NOT NULL,
+  PRIMARY KEY (id)
+);
+CREATE TABLE IF NOT EXISTS stale_blocks (
+  hash text NOT NULL,
+  height bigint NOT NULL,
+  replaced_by_height bigint NOT NULL,
+  replaced_by_hash text NOT NULL,
+  detected_at bigint NOT NULL,
+  dashboard_data_row jsonb NOT NULL,
+  PRIMARY KEY (hash)
+);
+CREATE TABLE IF NOT EXISTS mempool_data (
+  time bigint NOT NULL,
+  size bigint NOT NULL,
+  bytes bigint NOT NULL,
+  mempool_min_fee double precision NOT NULL,
+  size_diff bigint NOT NULL,
+  bytes_diff bigint NOT NULL,
+  mempool_min_fee_diff double precision NOT NULL,
+  size_per_fee_bucket bigint[] NOT NULL,
+  bytes_per_fee_bucket bigint[] NOT NULL,
+  total_fee_per_fee_bucket double precision[] NOT NULL,
+  size_per_fee_bucket_diff bigint[] NOT NULL,
+  bytes_per_fee_bucket_diff bigint[] NOT NULL,
+  total_fee_per_fee_bucket_diff double precision[] NOT NULL
+);
+
+-- 2: add version to dashboard_data_v2
+ALTER TABLE dashboard_data_v2 ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 2;
+
+-- 3: unique index on dashboard_data_v2 height
+CREATE UNIQUE INDEX IF NOT EXISTS dashboard_data_v2_height_key ON dashboard_data_v2 (height);
+
+-- 4: create backfill_chunks
+CREATE TABLE IF NOT EXISTS backfill_chunks (
+  start_height bigint NOT NULL,
+  end_height bigint NOT NULL,
+  last_height bigint NOT NULL,
+  owner text,
+  lease_expires timestamptz,
+  done boolean NOT NULL,
+  PRIMARY KEY (start_height)
+);
+
+-- 5: create and fill rollup tables
+CREATE INDEX IF NOT EXISTS dashboard_data_v2_time_idx ON dashboard_data_v2 (time);
+CREATE TABLE IF NOT EXISTS rollup_daily (bucket bigint PRIMARY KEY, changes bigint NOT NULL DEFAULT 0, recomputed_changes bigint NOT NULL DEFAULT 0, blocks bigint, first_height bigint, last_height bigint, first_time bigint, last_time bigint, num_txs bigint, num_inputs bigint, num_outputs bigint, num_segwit_txs bigint, total_fee bigint, subsidy bigint, total_amount_out bigint, total_block_size bigint, total_weight bigint, utxo_increase bigint, txs_signalling_opt_in_rbf bigint, consolidating_txs bigint, outputs_consolidated bigint, batching_txs bigint, non_coinbase_txs bigint, weighted_avg_fee numeric, weighted_avg_tx_size numeric, weighted_avg_fee_rate numeric, weighted_percent_inputs_consolidated numeric, avg_fee double precision, avg_tx_size double precision, avg_fee_rate double precision, percent_inputs_consolidated double precision, median_feerate_percentiles double precision[], block_size_percentiles double precision[], num_txs_percentiles double precision[]);
+TRUNCATE rollup_daily;
+INSERT INTO rollup_daily (bucket, changes, recomputed_changes, blocks, first_height, last_height, first_time, last_time, num_txs, num_inputs, num_outputs, num_segwit_txs, total_fee, subsidy, total_amount_out, total_block_size, total_weight, utxo_increase, txs_signalling_opt_in_rbf, consolidating_txs, outputs_consolidated, batching_txs, non_coinbase_txs, weighted_avg_fee, weighted_avg_tx_size, weighted_avg_fee_rate, weighted_percent_inputs_consolidated, median_feerate_percentiles, block_size_percentiles, num_txs_percentiles) SELECT time - (time - 0) % 86400, 1, 1, 1 * sum(1), min(height), max(height), min(time), max(time), 1 * sum(num_txs), 1 * sum(num_inputs), 1 * sum(num_outputs), 1 * sum(num_segwit_txs), 1 * sum(total_fee), 1 * sum(subsidy), 1 * sum(total_amount_out), 1 * sum(total_block_size), 1 * sum(total_weight), 1 * sum(utxo_increase), 1 * sum(txs_signalling_opt_in_rbf), 1 * sum(consolidating_txs), 1 * sum(outputs_consolidated), 1 * sum(batching_txs), 1 * sum(num_txs - 1), 1 * sum(avg_fee * (num_txs - 1)), 1 * sum(avg_tx_size * (num_txs - 1)), 1 * sum(avg_fee_rate * total_weight), 1 * sum(percent_inputs_consolidated::numeric * num_inputs), percentile_cont(ARRAY[0.1, 0.25, 0.5, 0.75, 0.9]) WITHIN GROUP (ORDER BY feerate_percentiles[3]), percentile_cont(ARRAY[0.1, 0.25, 0.5, 0.75, 0.9]) WITHIN GROUP (ORDER BY total_block_size), percentile_cont(ARRAY[0.1, 0.25, 0.5, 0.75, 0.9]) WITHIN GROUP (ORDER BY num_txs) FROM dashboard_data_v2 GROUP BY 1;
+UPDATE rollup_daily SET avg_fee = weighted_avg_fee / nullif(non_coinbase_txs, 0), avg_tx_size = weighted_avg_tx_size / nullif(non_coinbase_txs, 0), avg_fee_rate = weighted_avg_fee_rate / nullif(total_weight, 0), percent_inputs_consolidated = weighted_percent_inputs_consolidated / nullif(num_inputs, 0);
+CREATE TABLE IF NOT EXISTS rollup_weekly (bucket bigint PRIMARY KEY, changes bigint NOT NULL DEFAULT 0, recomputed_changes bigint NOT NULL DEFAULT 0, blocks bigint, first_height bigint, last_height bigint, first_time bigint, last_time bigint, num_txs bigint, num_inputs bigint, num_outputs bigint, num_segwit_txs bigint, total_fee bigint, subsidy bigint, total_amount_out bigint, total_block_size bigint, total_weight bigint, utxo_increase bigint, txs_signalling_opt_in_rbf bigint, consolidating_txs bigint, outputs_consolidated bigint, batching_txs bigint, non_coinbase_txs bigint, weighted_avg_fee numeric, weighted_avg_tx_size numeric, weighted_avg_fee_rate numeric, weighted_percent_inputs_consolidated numeric, avg_fee double precision, avg_tx_size double precision, avg_fee_rate double precision, percent_inputs_consolidated double precision, median_feerate_percentiles double precision[], block_size_percentiles double precision[], num_txs_percentiles double precision[]);
+TRUNCATE rollup_weekly;
+INSERT INTO rollup_weekly (bucket, changes, recomputed_changes, blocks, first_height, last_height, first_time, last_time, num_txs, num_inputs, num_outputs, num_segwit_txs, total_fee, subsidy, total_amount_out, total_block_size, total_weight, utxo_increase, txs_signalling_opt_in_rbf, consolidating_txs, outputs_consolidated, batching_txs, non_coinbase_txs, weighted_avg_fee, weighted_avg_tx_size, weighted_avg_fee_rate, weighted_percent_inputs_consolidated, median_feerate_percentiles, block_size_percentiles, num_txs_percentiles) SELECT time - (time - 345600) % 604800, 1, 1, 1 * sum(1), min(height), max(height), min(time), max(time), 1 * sum(num_txs), 1 * sum(num_inputs), 1 * sum(num_outputs), 1 * sum(num_segwit_txs), 1 * sum(total_fee), 1 * sum(subsidy), 1 * sum(total_amount_out), 1 * sum(total_block_size), 1 * sum(total_weight), 1 * sum(utxo_increase), 1 * sum(txs_signalling_opt_in_rbf), 1 * sum(consolidating_txs), 1 * sum(outputs_consolidated), 1 * sum(batching_txs), 1 * sum(num_txs - 1), 1 * sum(avg_fee * (num_txs - 1)), 1 * sum(avg_tx_size * (num_txs - 1)), 1 * sum(avg_fee_rate * total_weight), 1 * sum(percent_inputs_consolidated::numeric * num_inputs), percentile_cont(ARRAY[0.1, 0.25, 0.5, 0.75, 0.9]) WITHIN GROUP (ORDER BY feerate_percentiles[3]), percentile_cont(ARRAY[0.1, 0.25, 0.5, 0.75, 0.9]) WITHIN GROUP (ORDER BY total_block_size), percentile_cont(ARRAY[0.1, 0.25, 0.5, 0.75, 0.9]) WITHIN GROUP (ORDER BY num_txs) FROM dashboard_data_v2 GROUP BY 1;
+UPDATE rollup_weekly SET avg_fee = weighted_avg_fee / nullif(non_coinbase_txs, 0), avg_tx_size = weighted_avg_tx_size / nullif(non_coinbase_txs, 0), avg_fee_rate = weighted_avg_fee_rate / nullif(total_weight, 0), percent_inputs_consolidated = weighted_percent_inputs_consolidated / nullif(num_inputs, 0);
+CREATE TABLE IF NOT EXISTS rollup_difficulty_epoch (bucket bigint PRIMARY KEY, changes bigint NOT NULL DEFAULT 0, recomputed_changes bigint NOT NULL DEFAULT 0, blocks bigint, first_height bigint, last_height bigint, first_time bigint, last_time bigint, num_txs bigint, num_inputs bigint, num_outputs bigint, num_segwit_txs bigint, total_fee bigint, subsidy bigint, total_amount_out bigint, total_block_size bigint, total_weight bigint, utxo_increase bigint, txs_signalling_opt_in_rbf bigint, consolidating_txs bigint, outputs_consolidated bigint, batching_txs bigint, non_coinbase_txs bigint, weighted_avg_fee numeric, weighted_avg_tx_size numeric, weighted_avg_fee_rate numeric, weighted_percent_inputs_consolidated numeric, avg_fee double precision, avg_tx_size double precision, avg_fee_rate double precision, percent_inputs_consolidated double precision, median_feerate_percentiles double precision[], block_size_percentiles double precision[], num_txs_percentiles double precision[]);
+TRUNCATE rollup_difficulty_epoch;
+INSERT INTO rollup_difficulty_epoch (bucket, changes, recomputed_changes, blocks, first_height, last_height, first_time, last_time, num_txs, num_inputs, num_outputs, num_segwit_txs, total_fee, subsidy, total_amount_out, total_block_size, total_weight, utxo_increase, txs_signalling_opt_in_rbf, consolidating_txs, outputs_consolidated, batching_txs, non_coinbase_txs, weighted_avg_fee, weighted_avg_tx_size, weighted_avg_fee_rate, weighted_percent_inputs_consolidated, median_feerate_percentiles, block_size_percentiles, num_txs_percentiles) SELECT height - (height - 0) % 2016, 1, 1, 1 * sum(1), min(height), max(height), min(time), max(time), 1 * sum(num_txs), 1 * sum(num_inputs), 1 * sum(num_outputs), 1 * sum(num_segwit_txs), 1 * sum(total_fee), 1 * sum(subsidy), 1 * sum(total_amount_out), 1 * sum(total_block_size), 1 * sum(total_weight), 1 * sum(utxo_increase), 1 * sum(txs_signalling_opt_in_rbf), 1 * sum(consolidating_txs), 1 * sum(outputs_consolidated), 1 * sum(batching_txs), 1 * sum(num_txs - 1), 1 * sum(avg_fee * (num_txs - 1)), 1 * sum(avg_tx_size * (num_txs - 1)), 1 * sum(avg_fee_rate * total_weight), 1 * sum(percent_inputs_consolidated::numeric * num_inputs), percentile_cont(ARRAY[0.1, 0.25, 0.5, 0.75, 0.9]) WITHIN GROUP (ORDER BY feerate_percentiles[3]), percentile_cont(ARRAY[0.1, 0.25, 0.5, 0.75, 0.9]) WITHIN GROUP (ORDER BY total_block_size), percentile_cont(ARRAY[0.1, 0.25, 0.5, 0.75, 0.9]) WITHIN GROUP (ORDER BY num_txs) FROM dashboard_data_v2 GROUP BY 1;
+UPDATE rollup_difficulty_epoch SET avg_fee = weighted_avg_fee / nullif(non_coinbase_txs, 0), avg_tx_size = weighted_avg_tx_size / nullif(non_coinbase_txs, 0), avg_fee_rate = weighted_avg_fee_rate / nullif(total_weight, 0), percent_inputs_consolidated = weighted_percent_inputs_consolidated / nullif(num_inputs, 0);
+CREATE TABLE IF NOT EXISTS rollup_halving_epoch (bucket bigint PRIMARY KEY, changes bigint NOT NULL DEFAULT 0, recomputed_changes bigint NOT NULL DEFAULT 0, blocks bigint, first_height bigint, last_height bigint, first_time bigint, last_time bigint, num_txs bigint, num_inputs bigint, num_outputs bigint, num_segwit_txs bigint, total_fee bigint, subsidy bigint, total_amount_out bigint, total_block_size bigint, total_weight bigint, utxo_increase bigint, txs_signalling_opt_in_rbf bigint, consolidating_txs bigint, outputs_consolidated bigint, batching_txs bigint, non_coinbase_txs bigint, weighted_avg_fee numeric, weighted_avg_tx_size numeric, weighted_avg_fee_rate numeric, weighted_percent_inputs_consolidated numeric, avg_fee double precision, avg_tx_size double precision, avg_fee_rate double precision, percent_inputs_consolidated double precision, median_feerate_percentiles double precision[], block_size_percentiles double precision[], num_txs_percentiles double precision[]);
+TRUNCATE rollup_halving_epoch;
+INSERT INTO rollup_halving_epoch (bucket, changes, recomputed_changes, blocks, first_height, last_height, first_time, last_time, num_txs, num_inputs, num_outputs, num_segwit_txs, total_fee, subsidy, total_amount_out, total_block_size, total_weight, utxo_increase, txs_signalling_opt_in_rbf, consolidating_txs, outputs_consolidated, batching_txs, non_coinbase_txs, weighted_avg_fee, weighted_avg_tx_size, weighted_avg_fee_rate, weighted_percent_inputs_consolidated, median_feerate_percentiles, block_size_percentiles, num_txs_percentiles) SELECT height - (height - 0) % 210000, 1, 1, 1 * sum(1), min(height), max(height), min(time), max(time), 1 * sum(num_txs), 1 * sum(num_inputs), 1 * sum(num_outputs), 1 * sum(num_segwit_txs), 1 * sum(total_fee), 1 * sum(subsidy), 1 * sum(total_amount_out), 1 * sum(total_block_size), 1 * sum(total_weight), 1 * sum(utxo_increase), 1 * sum(txs_signalling_opt_in_rbf), 1 * sum(consolidating_txs), 1 * sum(outputs_consolidated), 1 * sum(batching_txs), 1 * sum(num_txs - 1), 1 * sum(avg_fee * (num_txs - 1)), 1 * sum(avg_tx_size * (num_txs - 1)), 1 * sum(avg_fee_rate * total_weight), 1 * sum(percent_inputs_consolidated::numeric * num_inputs), percentile_cont(ARRAY[0.1, 0.25, 0.5, 0.75, 0.9]) WITHIN GROUP (ORDER BY feerate_percentiles[3]), percentile_cont(ARRAY[0.1, 0.25, 0.5, 0.75, 0.9]) WITHIN GROUP (ORDER BY total_block_size), percentile_cont(ARRAY[0.1, 0.25, 0.5, 0.75, 0.9]) WITHIN GROUP (ORDER BY num_txs) FROM dashboard_data_v2 GROUP BY 1;
+UPDATE rollup_halving_epoch SET avg_fee = weighted_avg_fee / nullif(non_coinbase_txs, 0), avg_tx_size = weighted_avg_tx_size / nullif(non_coinbase_txs, 0), avg_fee_rate = weighted_avg_fee_rate / nullif(total_weight, 0), percent_inputs_consolidated = weighted_percent_inputs_consolidated / nullif(num_inputs, 0);
+
+-- 6: add backfill_id to the backfill_chunks primary key
+ALTER TABLE backfill_chunks ADD COLUMN IF NOT EXISTS backfill_id text NOT NULL DEFAULT '',
+  DROP CONSTRAINT IF EXISTS backfill_chunks_pkey,
+  ADD PRIMARY KEY (backfill_id, start_height);
+
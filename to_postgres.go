@@ -2,75 +2,264 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"runtime"
+	"sync"
+	"time"
 
 	"github.com/go-pg/pg"
-	"github.com/go-pg/pg/orm"
 )
 
+// Number of JSON backups bulk loaded into Postgres at a time.
+const INSERT_JSON_BATCH_SIZE = 10000
+
+// Malformed JSON backups are moved here by -insert-json, each next to a .reason file.
+const INSERT_JSON_REJECTS_DIR = "rejects"
+
+// Records how far an -insert-json got, removed once it finishes.
+const INSERT_JSON_PROGRESS_FILE = "insert-json-progress"
+
+// importProgress is the contents of INSERT_JSON_PROGRESS_FILE.
+type importProgress struct {
+	OnConflict string `json:"on_conflict"`
+	Last       int64  `json:"last"`
+}
+
 /*
 toPostgres() goes through all json files in db-dump,
-decodes the file to a their corresponding struct(s), and then inserts them into postgresql tables
+decodes the file to a their corresponding struct(s), and then bulk loads them into postgresql tables
 
-If more tables are desired, you would need to add a new db.Insert here,
+Files are decoded in parallel, old versions are upgraded, and malformed files are moved to the rejects directory.
+Progress is recorded after every batch, so a rerun continues after the last batch that was stored.
+
+If more tables are desired, you would need to add a new copy here,
 and define a new model using the new struct definition.
 */
 func toPostgres() {
-	DB_ADDR, ok := os.LookupEnv("DB_ADDR")
-	if !ok {
-		DB_ADDR = "http://localhost:5432"
+	if !USE_POSTGRES {
+		fatal("-insert-json needs Postgres")
+	}
+	if _, err := os.Stat(JSON_DIR); os.IsNotExist(err) {
+		return
+	}
+
+	createDirIfNotExist(JSON_DIR + "/" + INSERT_JSON_REJECTS_DIR)
+
+	heights := storedJSONHeights()
+	total := len(heights)
+
+	progress, ok := readImportProgress()
+	if ok {
+		log.Printf("Continuing -insert-json after height %v\n", progress.Last)
+		heights = heightsAfter(heights, progress.Last)
+	}
+
+	// Heights that are already stored would be skipped anyway. Overwrite needs to load them, and error to fail on them.
+	if ON_CONFLICT == ON_CONFLICT_SKIP {
+		var existing int
+		heights, existing = withoutStoredHeights(heights)
+		log.Printf("Loading %v of %v JSON backups into Postgres, %v are already stored\n", len(heights), total, existing)
+	} else {
+		log.Printf("Loading %v of %v JSON backups into Postgres (-on-conflict=%v)\n", len(heights), total, ON_CONFLICT)
+	}
+
+	startTime := time.Now()
+	written, rejected := 0, 0
+	for start := 0; start < len(heights); start += INSERT_JSON_BATCH_SIZE {
+		if start > 0 && stopRequested() {
+			log.Printf("Stopping -insert-json, run it again to continue after height %v\n", heights[start-1])
+			return
+		}
+
+		end := start + INSERT_JSON_BATCH_SIZE
+		if end > len(heights) {
+			end = len(heights)
+		}
+
+		rows := importDataFiles(heights[start:end])
+		rejected += (end - start) - len(rows)
+
+		if len(rows) > 0 {
+			var n int
+			err := retry("PG copy", func() (err error) {
+				n, err = copyRows(pgPool, rows)
+				return err
+			})
+			if err != nil {
+				fatal("Error inserting into db: ", err)
+			}
+			written += n
+		}
+
+		err := writeImportProgress(importProgress{OnConflict: ON_CONFLICT, Last: heights[end-1]})
+		if err != nil {
+			fatal("Error writing -insert-json progress: ", err)
+		}
+
+		elapsed := time.Since(startTime)
+		log.Printf("Done with %v of %v files up to height %v after %v, %.0f rows/s\n", end, len(heights), heights[end-1], elapsed, float64(end)/elapsed.Seconds())
+	}
+
+	os.Remove(JSON_DIR + "/" + INSERT_JSON_PROGRESS_FILE)
+	refreshStaleRollups()
+	log.Printf("Loaded %v JSON backups (%v rows written, -on-conflict=%v, %v rejected) in %v\n", len(heights), written, ON_CONFLICT, rejected, time.Since(startTime))
+	if rejected > 0 {
+		log.Printf("Rejected files are in %v/%v, use -gaps to analyze their heights again\n", JSON_DIR, INSERT_JSON_REJECTS_DIR)
+	}
+}
+
+// importDataFiles decodes the JSON backups for the given heights in parallel, and returns their rows in height order.
+// Files that can't be imported are moved to the rejects directory.
+func importDataFiles(heights []int64) []DashboardDataV2 {
+	rows := make([]DashboardDataV2, len(heights))
+	ok := make([]bool, len(heights))
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+
+	// Decoding is CPU bound, so there's no point in more decoders than CPUs.
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				data, err := importDataFile(heights[i])
+				if err != nil {
+					rejectDataFile(heights[i], err)
+					continue
+				}
+				rows[i], ok[i] = data.DashboardDataRow, true
+			}
+		}()
+	}
+
+	for i := range heights {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	imported := make([]DashboardDataV2, 0, len(heights))
+	for i, row := range rows {
+		if ok[i] {
+			imported = append(imported, row)
+		}
+	}
+
+	return imported
+}
+
+// importDataFile reads the JSON backup for a height, checks that it holds that block,
+// and upgrades it to CURRENT_VERSION_NUMBER.
+func importDataFile(height int64) (Data, error) {
+	data, err := decodeDataFile(fmt.Sprintf("%v/%v.json", JSON_DIR, height))
+	if err != nil {
+		return data, err
 	}
 
-	db := pg.Connect(&pg.Options{
-		Addr:     DB_ADDR,
-		User:     os.Getenv("DB_USERNAME"),
-		Password: os.Getenv("DB_PASSWORD"),
-		Database: os.Getenv("DB"),
-	})
+	row := data.DashboardDataRow
+	switch {
+	case data.Version <= 0:
+		return data, fmt.Errorf("missing version")
+	case data.Version > CURRENT_VERSION_NUMBER:
+		return data, fmt.Errorf("version %v is newer than this program knows (%v)", data.Version, CURRENT_VERSION_NUMBER)
+	case row.Height != height:
+		return data, fmt.Errorf("file holds height %v", row.Height)
+	case row.Hash == "":
+		return data, fmt.Errorf("missing block hash")
+	}
 
-	defer db.Close()
+	err = upgradeData(&data)
+
+	return data, err
+}
 
-	model := interface{}((*DashboardDataV2)(nil))
-	err := db.CreateTable(model, &orm.CreateTableOptions{
-		Temp:        false,
-		IfNotExists: true,
-	})
+// rejectDataFile moves the JSON backup for a height to the rejects directory, with the reason in a file next to it.
+func rejectDataFile(height int64, reason error) {
+	dir := JSON_DIR + "/" + INSERT_JSON_REJECTS_DIR
+	name := fmt.Sprintf("%v.json", height)
+	log.Printf("Rejecting JSON backup %v: %v\n", name, reason)
+
+	err := ioutil.WriteFile(dir+"/"+name+".reason", []byte(reason.Error()+"\n"), 0666)
+	if err == nil {
+		err = os.Rename(JSON_DIR+"/"+name, dir+"/"+name)
+	}
 	if err != nil {
-		fatal("Error creating table: ", err)
+		fatal("Error moving rejected JSON backup: ", err)
 	}
+}
 
-	if _, err := os.Stat(JSON_DIR); os.IsNotExist(err) {
-		return
+// withoutStoredHeights returns the heights that aren't in Postgres yet, and how many were left out.
+func withoutStoredHeights(heights []int64) ([]int64, int) {
+	if len(heights) == 0 {
+		return heights, 0
 	}
 
-	files, err := ioutil.ReadDir(JSON_DIR)
+	var stored pg.Ints
+	_, err := pgPool.Query(&stored, `SELECT height FROM dashboard_data_v2 WHERE height BETWEEN ? AND ?`, heights[0], heights[len(heights)-1])
 	if err != nil {
-		fatal("Error reading directory", err)
+		fatal("Error reading stored heights: ", err)
 	}
 
-	for i, fileInfo := range files {
-		file, err := os.Open(JSON_DIR + "/" + fileInfo.Name())
-		if err != nil {
-			fatal(i, err, fileInfo.Name())
+	isStored := make(map[int64]bool, len(stored))
+	for _, height := range stored {
+		isStored[height] = true
+	}
+
+	missing := make([]int64, 0, len(heights))
+	for _, height := range heights {
+		if !isStored[height] {
+			missing = append(missing, height)
 		}
+	}
 
-		dec := json.NewDecoder(file)
-		var data Data
+	return missing, len(heights) - len(missing)
+}
 
-		err = dec.Decode(&data)
-		if err != nil {
-			fatal("JSON decoding error: ", err, fileInfo.Name())
+// heightsAfter returns the heights above last, heights must be in ascending order.
+func heightsAfter(heights []int64, last int64) []int64 {
+	for i, height := range heights {
+		if height > last {
+			return heights[i:]
 		}
+	}
+	return nil
+}
 
-		file.Close()
+// readImportProgress reads the progress of an unfinished -insert-json. Progress made with a different
+// -on-conflict doesn't count, e.g. a run with -on-conflict=overwrite goes over everything again.
+func readImportProgress() (importProgress, bool) {
+	var progress importProgress
 
-		err = db.Insert(&data.DashboardDataRow)
-		if err != nil {
-			fatal("Error inserting into db: ", err)
-		}
+	contents, err := ioutil.ReadFile(JSON_DIR + "/" + INSERT_JSON_PROGRESS_FILE)
+	if err != nil {
+		return progress, false
+	}
+
+	err = json.Unmarshal(contents, &progress)
+	if err != nil {
+		log.Printf("Ignoring unreadable -insert-json progress: %v\n", err)
+		return progress, false
+	}
 
-		log.Println("Done with file: ", fileInfo.Name())
+	return progress, progress.OnConflict == ON_CONFLICT
+}
+
+// writeImportProgress replaces the -insert-json progress file, see writeProgress.
+func writeImportProgress(progress importProgress) error {
+	contents, err := json.Marshal(progress)
+	if err != nil {
+		return err
 	}
+
+	path := JSON_DIR + "/" + INSERT_JSON_PROGRESS_FILE
+	err = ioutil.WriteFile(path+".tmp", contents, 0666)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
 }
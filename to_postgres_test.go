@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestImportDataFilesRejectsBadBackups(t *testing.T) {
+	useJSONBackups(t)
+	createDirIfNotExist(JSON_DIR + "/" + INSERT_JSON_REJECTS_DIR)
+
+	storeDataAsFile(Data{CURRENT_VERSION_NUMBER, derivedRow(1)})
+	storeDataAsFile(Data{CURRENT_VERSION_NUMBER + 1, derivedRow(3)})
+	storeDataAsFile(Data{0, derivedRow(4)})
+	noHash := derivedRow(5)
+	noHash.Hash = ""
+	storeDataAsFile(Data{CURRENT_VERSION_NUMBER, noHash})
+	storeDataAsFile(Data{CURRENT_VERSION_NUMBER, derivedRow(7)})
+	if err := os.Rename(JSON_DIR+"/7.json", JSON_DIR+"/6.json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(JSON_DIR+"/2.json", []byte(`{"version": `), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := importDataFiles([]int64{1, 2, 3, 4, 5, 6})
+	if len(rows) != 1 || rows[0].Height != 1 || rows[0].Version != CURRENT_VERSION_NUMBER {
+		t.Errorf("imported %+v, want only height 1", rows)
+	}
+
+	reasons := map[int64]string{
+		2: "JSON decoding error",
+		3: "is newer than this program knows",
+		4: "missing version",
+		5: "missing block hash",
+		6: "file holds height 7",
+	}
+	for height, want := range reasons {
+		name := JSON_DIR + "/" + INSERT_JSON_REJECTS_DIR + "/" + fmt.Sprint(height) + ".json"
+		reason, err := ioutil.ReadFile(name + ".reason")
+		if err != nil || !strings.Contains(string(reason), want) {
+			t.Errorf("reason for height %v: %q (%v), want %q", height, reason, err, want)
+		}
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("rejected backup %v wasn't moved: %v", height, err)
+		}
+		if _, ok := readDataFile(height); ok {
+			t.Errorf("rejected backup %v is still in the backups", height)
+		}
+	}
+
+	if _, ok := readDataFile(1); !ok {
+		t.Errorf("imported backup 1 was moved")
+	}
+}
+
+func TestImportProgressResumes(t *testing.T) {
+	useJSONBackups(t)
+	saved := ON_CONFLICT
+	t.Cleanup(func() { ON_CONFLICT = saved })
+	ON_CONFLICT = ON_CONFLICT_SKIP
+
+	if _, ok := readImportProgress(); ok {
+		t.Errorf("progress found without a progress file")
+	}
+
+	if err := writeImportProgress(importProgress{OnConflict: ON_CONFLICT_SKIP, Last: 5}); err != nil {
+		t.Fatal(err)
+	}
+	progress, ok := readImportProgress()
+	if !ok || progress.Last != 5 {
+		t.Fatalf("progress %+v, %v, want last height 5", progress, ok)
+	}
+	if heights := heightsAfter([]int64{1, 3, 5, 6, 9}, progress.Last); !reflect.DeepEqual(heights, []int64{6, 9}) {
+		t.Errorf("heights left %v, want [6 9]", heights)
+	}
+	if heights := heightsAfter([]int64{1, 3, 5}, progress.Last); len(heights) != 0 {
+		t.Errorf("heights left %v after the last one", heights)
+	}
+
+	// Progress made with another -on-conflict doesn't count.
+	ON_CONFLICT = ON_CONFLICT_OVERWRITE
+	if _, ok := readImportProgress(); ok {
+		t.Errorf("progress of -on-conflict=skip used with overwrite")
+	}
+
+	ON_CONFLICT = ON_CONFLICT_SKIP
+	if err := ioutil.WriteFile(JSON_DIR+"/"+INSERT_JSON_PROGRESS_FILE, []byte("{"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readImportProgress(); ok {
+		t.Errorf("unreadable progress used")
+	}
+}
@@ -5,16 +5,34 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"sync"
+	"strings"
 	"time"
 )
 
 var SEND_EMAIL bool
 var N_WORKERS int
+var MIN_WORKERS int
+var MAX_WORKERS int
+var CHUNK_SIZE int
+var DISTRIBUTED bool
+var LEASE_DURATION time.Duration
+var MAX_ATTEMPTS int
+var RETRY_BASE_DELAY time.Duration
+var RETRY_MAX_DELAY time.Duration
+var RPC_BATCH_SIZE int
+var ON_CONFLICT string
+var ROLLUPS bool
+var RPC_POOL_SIZE int
+var DB_POOL_SIZE int
 var BACKUP_JSON bool
+var USE_POSTGRES bool
 var JSON_DIR string
+var SQLITE_PATH string
+var CSV_DIR string
 var WORKER_PROGRESS_DIR string
 var MIN_DIST_FROM_TIP int64
+var FILL_GAPS bool
+var GAP_FLOOR int64
 
 const SHOW_QUERIES = false
 const JSON_DIR_RELATIVE = "/db-backup"
@@ -22,30 +40,101 @@ const WORKER_PROGRESS_DIR_RELATIVE = "/worker-progress"
 
 const N_WORKERS_DEFAULT = 2
 const DB_WAIT_TIME = 30
-const MAX_ATTEMPTS = 3 // max number of DB write attempts before giving up
+const MAX_ATTEMPTS_DEFAULT = 8 // max number of RPC or DB attempts before giving up
 const DEFAULT_DIST_FROM_TIP = 6
 
-const CURRENT_VERSION_NUMBER = 2
+const CURRENT_VERSION_NUMBER = 3
 
 func main() {
 	sendEmailPtr := flag.Bool("email", false, "Set to true to send email upon failure. \n(Need to set additional environment variables, RECIPIENT_EMAILS should be a comma-separated list of recipient emails, \n EMAIL_ADDR, EMAIL_PASSWORD for sending address must also be set)")
-	tipDistPtr := flag.Int64("tipdist", DEFAULT_DIST_FROM_TIP, "Number of blocks behind tip (during live analysis).")
-	nWorkersPtr := flag.Int("workers", N_WORKERS_DEFAULT, "Number of concurrent workers.")
+	tipDistPtr := flag.Int64("tipdist", DEFAULT_DIST_FROM_TIP, "Number of blocks behind tip (during live analysis). Reorgs are handled, so this can be 0.")
+	nWorkersPtr := flag.Int("workers", N_WORKERS_DEFAULT, "Number of concurrent workers. Backfills adjust this between -min-workers and -max-workers.")
+	minWorkersPtr := flag.Int("min-workers", MIN_WORKERS_DEFAULT, "Fewest concurrent getblockstats requests during backfills.")
+	maxWorkersPtr := flag.Int("max-workers", MAX_WORKERS_DEFAULT, "Most concurrent getblockstats requests during backfills.")
+	distributedPtr := flag.Bool("distributed", false, "Set to true to share backfill chunks with other processes through PostgreSQL. Without -end, helps out with an existing backfill.")
+	leasePtr := flag.Duration("lease", LEASE_DURATION_DEFAULT, "How long a -distributed process holds on to a chunk without recording progress.")
+	retriesPtr := flag.Int("retries", MAX_ATTEMPTS_DEFAULT, "Number of attempts at an RPC or database call before giving up.")
+	retryDelayPtr := flag.Duration("retry-delay", RETRY_BASE_DELAY_DEFAULT, "Wait before the first retry, doubled after every failed attempt.")
+	retryMaxDelayPtr := flag.Duration("retry-max-delay", RETRY_MAX_DELAY_DEFAULT, "Longest wait between retries.")
+	rpcBatchPtr := flag.Int("rpc-batch", RPC_BATCH_SIZE_DEFAULT, "Number of getblockstats calls sent in one request during backfills. 1 disables batching.")
+	rpcPoolPtr := flag.Int("rpc-pool", RPC_POOL_SIZE_DEFAULT, "Number of RPC connections to bitcoind shared by all workers.")
+	dbPoolPtr := flag.Int("db-pool", DB_POOL_SIZE_DEFAULT, "Number of PostgreSQL connections shared by all workers.")
+	chunkSizePtr := flag.Int("chunk-size", CHUNK_SIZE_DEFAULT, "Number of blocks a backfill worker takes from the queue at a time.")
 	startPtr := flag.Int("start", 0, "Starting blockheight.")
 	endPtr := flag.Int("end", -1, "Last blockheight to analyze.")
+	startDatePtr := flag.String("start-date", "", "Start at the first block on or after this date (YYYY-MM-DD in UTC, or RFC 3339). Overrides -start.")
+	endDatePtr := flag.String("end-date", "", "Stop before the first block on or after this date (YYYY-MM-DD in UTC, or RFC 3339). Overrides -end.")
+	fillGapsPtr := flag.Bool("fill-gaps", true, "Set to false to skip filling in missing heights before live analysis.")
+	gapFloorPtr := flag.Int64("gap-floor", -1, "Lowest height checked for gaps. Defaults to the lowest stored height.")
 
 	// Flags for different modes of operation. Default is to live analysis/back-filling.
 	mempoolPtr := flag.Bool("mempool", false, "Set to true to start a mempool analysis")
 	insertPtr := flag.Bool("insert-json", false, "Set to true to insert .json data files into PostgreSQL")
 	recoveryFlagPtr := flag.Bool("recovery", false, "Set to true to start workers on files in ./worker-progress")
+	verifyPtr := flag.Bool("verify", false, "Set to true to compare stored blocks in [-start, -end) with fresh getblockstats results")
+	repairPtr := flag.Bool("repair", false, "Set to true with -verify to overwrite mismatching stored blocks")
+	recomputePtr := flag.Bool("recompute-derived", false, "Set to true to recompute the derived columns of stored blocks in [-start, -end) without calling getblockstats")
+	rebuildRollupsPtr := flag.Bool("rebuild-rollups", false, "Set to true to recompute the daily, weekly and epoch rollup tables from scratch, then exit")
+	migratePtr := flag.Bool("migrate", false, "Set to true to apply database migrations and upgrade JSON backups written by older versions, then exit")
+	gapsPtr := flag.Bool("gaps", false, "Set to true to fill in all heights missing from PostgreSQL between -gap-floor and the tip")
 	jsonPtr := flag.Bool("json", true, "Set to false to stop json logging in /db-backup")
+	onConflictPtr := flag.String("on-conflict", ON_CONFLICT_DEFAULT, "What to do with blocks that are already in PostgreSQL: skip, overwrite (only rows with an older version), or error.")
+	rollupsPtr := flag.Bool("rollups", true, "Set to false to stop updating the rollup tables as blocks are stored, e.g. during a big backfill. Rebuild them with -rebuild-rollups afterwards.")
+	metricsAddrPtr := flag.String("metrics-addr", "", "Address to serve metrics (e.g. the spool depth) on at /debug/vars, e.g. localhost:9100. Off by default.")
+	postgresPtr := flag.Bool("postgres", true, "Set to false to only store block data as json files in /db-backup")
+	sinksPtr := flag.String("sinks", "", "Comma-separated list of where to store data: postgres, json, sqlite, csv. Overrides -postgres and -json.")
+	sqlitePathPtr := flag.String("sqlite-path", SQLITE_PATH_DEFAULT, "SQLite database file used by the sqlite sink.")
+	csvDirPtr := flag.String("csv-dir", CSV_DIR_DEFAULT, "Directory of the CSV files written by the csv sink.")
 	flag.Parse()
 
 	// Set global variables
 	N_WORKERS = *nWorkersPtr
+	MIN_WORKERS = *minWorkersPtr
+	MAX_WORKERS = *maxWorkersPtr
+	if MIN_WORKERS < 1 {
+		MIN_WORKERS = 1
+	}
+	if MAX_WORKERS < N_WORKERS {
+		MAX_WORKERS = N_WORKERS
+	}
+	CHUNK_SIZE = *chunkSizePtr
+	DISTRIBUTED = *distributedPtr
+	LEASE_DURATION = *leasePtr
+	MAX_ATTEMPTS = *retriesPtr
+	RETRY_BASE_DELAY = *retryDelayPtr
+	RETRY_MAX_DELAY = *retryMaxDelayPtr
+	RPC_BATCH_SIZE = *rpcBatchPtr
+	ON_CONFLICT = *onConflictPtr
+	ROLLUPS = *rollupsPtr
+	RPC_POOL_SIZE = *rpcPoolPtr
+	DB_POOL_SIZE = *dbPoolPtr
 	BACKUP_JSON = *jsonPtr
+	USE_POSTGRES = *postgresPtr
 	MIN_DIST_FROM_TIP = *tipDistPtr
 	SEND_EMAIL = *sendEmailPtr
+	FILL_GAPS = *fillGapsPtr
+	GAP_FLOOR = *gapFloorPtr
+
+	SQLITE_PATH = *sqlitePathPtr
+	CSV_DIR = *csvDirPtr
+
+	sinkNames, err := parseSinks(*sinksPtr, USE_POSTGRES, BACKUP_JSON)
+	if err != nil {
+		log.Fatal(err)
+	}
+	USE_POSTGRES, BACKUP_JSON = false, false
+	for _, name := range sinkNames {
+		USE_POSTGRES = USE_POSTGRES || name == SINK_POSTGRES
+		BACKUP_JSON = BACKUP_JSON || name == SINK_JSON
+	}
+
+	if len(sinkNames) == 0 {
+		log.Fatal("-postgres=false requires -json or -sinks to store results somewhere!")
+	}
+
+	if err := checkOnConflict(); err != nil {
+		log.Fatal(err)
+	}
 
 	currentDir, err := os.Getwd()
 	if err != nil {
@@ -64,6 +153,16 @@ func main() {
 		createDirIfNotExist(WORKER_PROGRESS_DIR)
 	}
 
+	// Create spool directory for rows that couldn't be written to Postgres.
+	if USE_POSTGRES {
+		SPOOL_DIR = currentDir + SPOOL_DIR_RELATIVE
+		createDirIfNotExist(SPOOL_DIR)
+	}
+
+	if *metricsAddrPtr != "" {
+		serveMetrics(*metricsAddrPtr)
+	}
+
 	if SEND_EMAIL {
 		_, ok1 := os.LookupEnv("RECIPIENT_EMAILS")
 		_, ok2 := os.LookupEnv("EMAIL_ADDR")
@@ -74,20 +173,71 @@ func main() {
 		}
 	}
 
+	// Connections and schema are set up once and shared by all workers.
+	setupPools()
+	defer closePools()
+
+	setupSinks(sinkNames, *sinksPtr != "")
+	defer closeSinks()
+
+	if *migratePtr {
+		migrate()
+		return
+	}
+
+	if *rebuildRollupsPtr {
+		rebuildRollups()
+		return
+	}
+
 	if *mempoolPtr {
 		liveMempoolAnalysis()
 		return
 	}
 
+	if USE_POSTGRES {
+		startSpoolReplayer()
+	}
+
+	// Dates are resolved to heights up front, so every mode that takes -start/-end accepts them.
+	if *startDatePtr != "" || *endDatePtr != "" {
+		*startPtr, *endPtr = resolveDates(*startDatePtr, *endDatePtr, *startPtr, *endPtr)
+	}
+
+	// Modes below stop cleanly on SIGINT and SIGTERM.
+	handleSignals()
+
 	if *insertPtr {
 		toPostgres()
 		return
 	}
 
+	if *verifyPtr {
+		requireStoredBlocks("-verify")
+		verifyBlocks(int64(*startPtr), int64(*endPtr), *repairPtr)
+		return
+	}
+
+	if *recomputePtr {
+		requireStoredBlocks("-recompute-derived")
+		recomputeDerived(int64(*startPtr), int64(*endPtr))
+		return
+	}
+
+	if *gapsPtr {
+		requireStoredBlocks("-gaps")
+		checkGaps()
+		return
+	}
+
 	if *recoveryFlagPtr {
 		recoverFromFailure()
 	}
 
+	if stopRequested() {
+		return
+	}
+
 	// If an end value is given, analyze that range.
 	// ( the start value defaults to 0)
 	if *endPtr > 0 {
@@ -95,86 +245,34 @@ func main() {
 		return
 	}
 
+	// Join a distributed backfill started by another process.
+	if DISTRIBUTED {
+		runBackfill(nil)
+		return
+	}
+
 	// Given no arguments, start live analysis.
+	requireStoredBlocks("Live analysis")
 	doLiveAnalysis(*startPtr)
 }
 
-// Splits up work across N_WORKERS workers,each with their own RPC/db clients.
-func startBackfill(start, end int) {
-	var wg sync.WaitGroup
-	workSplit := (end - start) / N_WORKERS
-	log.Println("Work split: ", workSplit, end-start, start, end)
-
-	formattedTime := time.Now().Format("01-02:15:04")
-	for i := 0; i < N_WORKERS; i++ {
-		wg.Add(1)
-		go func(i int) {
-			analyzeBlockRange(formattedTime, i, start+(workSplit*i), start+(workSplit*(i+1)))
-			wg.Done()
-		}(i)
+// requireStoredBlocks exits unless stored blocks can be read back, from Postgres or the JSON files.
+// mode needs them e.g. to resume, find gaps or detect reorgs.
+func requireStoredBlocks(mode string) {
+	if !USE_POSTGRES && !BACKUP_JSON {
+		log.Fatal(mode + " reads stored blocks back, and needs the postgres or json sink")
 	}
-	wg.Wait()
 }
 
-// Analyzes all blocks from in the interval [start, end)
-func analyzeBlockRange(formattedTime string, workerID, start, end int) {
-	worker := setupWorker(formattedTime, workerID)
-	defer worker.shutdown()
-
-	// Keep track of time since last write.
-	// If it was less than DB_WAIT_TIME seconds ago. don't write yet.
-	// prevents us from overwhelming the database.
-	lastWriteTime := time.Now()
-	lastWriteTime = lastWriteTime.Add(DB_WAIT_TIME * time.Second)
-
-	startTime := time.Now()
-
-	// Record progress in file.
-	logProgressToFile(start, start, end, worker.workFile)
-
-	for i := start; i < end; i++ {
-		startBlock := time.Now()
-		worker.analyzeBlock(int64(i))
-		log.Printf("Worker %v: Done with %v blocks total (height=%v) after %v (%v) \n", workerID, i-start+1, i, time.Since(startTime), time.Since(startBlock))
-
-		// Only perform the write to database if there hasn't been a write in the last 5 seconds.
-		// And make sure to do the write before finishing.
-		if !time.Now().After(lastWriteTime) && (i != end-1) {
-			continue
-		}
-
-		// Write to database.
-		ok := worker.commitBatchInsert()
-		if !ok {
-			log.Println("DB write failed!", workerID)
-			return
-		}
-
-		lastWriteTime = time.Now().Add(DB_WAIT_TIME * time.Second)
-
-		// Record progress in file, overwriting previous record.
-		logProgressToFile(start, i+1, end, worker.workFile)
-	}
-
-	log.Printf("Worker %v done analyzing %v blocks (height=%v) after %v\n", workerID, end-start, end, time.Since(startTime))
-}
-
-// analyzeBlock uses the getblockstats RPC to compute metrics of a single block.
-// It then stores the results in a batch to be inserted to db later.
-func (worker *Worker) analyzeBlock(blockHeight int64) {
-	// Use getblockstats RPC and merge results into the metrics struct.
-	blockStatsRes, err := worker.client.GetBlockStats(blockHeight, nil)
-	if err != nil {
-		fatal("Error with getblockstats RPC: ", err)
-	}
-
-	blockStats := BlockStats{blockStatsRes}
-
-	worker.batchInsert(blockStats)
+// startBackfill analyzes all blocks in the interval [start, end) with N_WORKERS workers.
+func startBackfill(start, end int) {
+	runBackfill([]heightRange{{int64(start), int64(end)}})
 }
 
 // recoverFromFailure checks the worker-progress directory for any unfinished work from a previous job.
-// If there is any, it starts a new worker to continue the work for each previously failed worker.
+// The unfinished parts of all progress records are merged, heights that are already stored are left out,
+// and the rest is handed to the scheduler like any other backfill.
+// Records whose lock is held by a process that is still running, and records that can't be read, are skipped.
 func recoverFromFailure() {
 	log.Println("Starting Recovery Process.")
 
@@ -183,75 +281,139 @@ func recoverFromFailure() {
 		fatal("Error reading worker_progress directory: ", err)
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(len(files))
+	// Lock files by path, nil if another process holds the lock.
+	locks := make(map[string]*os.File)
 
-	workers := make(chan struct{}, N_WORKERS)
-	for i := 0; i < N_WORKERS; i++ { // Signal that there are available workers.
-		workers <- struct{}{}
-	}
+	ranges := make([]heightRange, 0, len(files))
+	claimed := make([]string, 0, len(files))
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".lock") || strings.HasSuffix(file.Name(), ".tmp") {
+			continue
+		}
+		path := WORKER_PROGRESS_DIR + "/" + file.Name()
 
-	progressFiles := make([]os.FileInfo, len(files))
-	for i := 0; i < len(files); i++ {
-		progressFiles[i] = files[i]
-	}
+		progress, err := readProgress(path)
+		if err != nil {
+			// Another recovery may have claimed it after the directory was read.
+			if !os.IsNotExist(err) {
+				log.Printf("Skipping progress record %v: %v\n", file.Name(), err)
+			}
+			continue
+		}
 
-	i := 0 // index into files, incremented at bottom of loop.
-	for i < len(files) {
-		// Check if any workers are free.
-		select {
-		case <-workers:
-		default:
-			// If all workers are busy, wait and continue.
-			time.Sleep(1000 * time.Millisecond)
+		lockPath := progress.lockPath(path)
+		lock, ok := locks[lockPath]
+		if !ok {
+			lock, err = lockFile(lockPath)
+			if err != nil {
+				log.Printf("Skipping progress records locked by another process (%v): %v\n", lockPath, err)
+			}
+			locks[lockPath] = lock
+		}
+		if lock == nil {
 			continue
 		}
 
-		file := progressFiles[i]
-		contentsBytes, err := ioutil.ReadFile(WORKER_PROGRESS_DIR + "/" + file.Name())
+		// Re-read under the lock, the record may have been finished or claimed in the meantime.
+		progress, err = readProgress(path)
 		if err != nil {
-			fatal("Error reading wp file: ", err)
+			continue
 		}
-		contents := string(contentsBytes)
-		progress := parseProgress(contents)
-		log.Printf("Starting recovery worker %v on range [%v, %v) at height %v\n", i, progress[0], progress[2], progress[1])
-		go func(i int) {
-			analyzeBlockRange(time.Now().Format("01-02:15:04"), i, progress[1], progress[2])
-			workers <- struct{}{}
-			wg.Done()
-		}(i)
 
-		err = os.Remove(WORKER_PROGRESS_DIR + "/" + file.Name())
+		log.Printf("Recovering range [%v, %v) at height %v (worker %v on %v, pid %v, last updated %v)\n",
+			progress.Start, progress.End, progress.Last, progress.Worker, progress.Host, progress.Pid, progress.Updated)
+		ranges = append(ranges, heightRange{int64(progress.Last), int64(progress.End)})
+		claimed = append(claimed, path)
+	}
+
+	// Records can overlap, e.g. if an earlier recovery was killed, and parts may have been stored since.
+	worker := setupWorker()
+	remaining := make([]heightRange, 0)
+	leftover, missing := int64(0), int64(0)
+	for _, r := range mergeRanges(ranges) {
+		leftover += r.End - r.Start
+		for _, gap := range worker.findGaps(r.Start, r.End) {
+			missing += gap.End - gap.Start
+			remaining = append(remaining, gap)
+		}
+	}
+	log.Printf("Recovering %v missing heights in %v ranges (%v heights left in progress records)\n", missing, len(remaining), leftover)
+
+	// The claimed records and their locks are only removed once the new records for what is left of
+	// them are written, so a crash in between leaves both behind rather than neither.
+	source := newChunkSource(remaining)
+	for _, path := range claimed {
+		err := os.Remove(path)
 		if err != nil {
 			fatal("Error removing file: ", err)
 		}
-
-		i++
 	}
-	wg.Wait()
+	for _, lock := range locks {
+		if lock != nil {
+			unlockFile(lock, true)
+		}
+	}
+
+	backfillChunks(source)
 
 	log.Println("Finished with Recovery.")
 }
 
+// catchUpEnd returns the end of the range live analysis backfills before it takes over.
+// A backfill stores blocks by height without checking that they build on each other, so it
+// stays out of reach of reorgs, and the blocks above go through the hash checks of live analysis.
+func catchUpEnd(blockCount int64) int64 {
+	depth := int64(MAX_REORG_DEPTH)
+	if MIN_DIST_FROM_TIP > depth {
+		depth = MIN_DIST_FROM_TIP
+	}
+	return blockCount - depth + 1
+}
+
 // doLiveAnalysis does an analysis of blocks as they come in live.
-// In order to avoid dealing with re-org in this code-base, it should
-// stay at least 6 blocks behind.
+// It stays MIN_DIST_FROM_TIP blocks behind the tip, which may be zero since
+// blocks that get re-organized out of the best chain are rolled back and re-analyzed.
 func doLiveAnalysis(height int) {
 	log.Println("Starting a live analysis of the blockchain.")
 
-	worker := setupWorker(time.Now().Format("01-02:15:04"), height)
-	defer worker.shutdown()
+	worker := setupWorker()
 
-	blockCount, err := worker.client.GetBlockCount()
-	if err != nil {
-		fatal("Error with getblockcount RPC: ", err)
-	}
+	blockCount := worker.getBlockCount()
 
+	// Without a starting height, continue after the last block stored by a previous run.
 	var lastAnalysisStarted int64
-	if height == 0 {
-		lastAnalysisStarted = blockCount - MIN_DIST_FROM_TIP
-	} else {
+	if height != 0 {
 		lastAnalysisStarted = int64(height)
+	} else if lastStored := worker.lastStoredHeight(); lastStored >= 0 {
+		lastAnalysisStarted = lastStored + 1
+		log.Printf("Resuming live analysis after last stored height %v\n", lastStored)
+	} else {
+		lastAnalysisStarted = blockCount - MIN_DIST_FROM_TIP
+	}
+
+	// Fill in anything missed by earlier runs before moving on.
+	if FILL_GAPS {
+		worker.fillGaps(GAP_FLOOR, lastAnalysisStarted)
+	}
+	if stopRequested() {
+		return
+	}
+
+	// While far behind the tip, catch up with a parallel backfill instead of one insert per block.
+	for {
+		end := catchUpEnd(blockCount)
+		if end-lastAnalysisStarted <= int64(N_WORKERS) {
+			break
+		}
+
+		log.Printf("Catching up to %v blocks behind the tip with a backfill of [%v, %v)\n", blockCount-end+1, lastAnalysisStarted, end)
+		startBackfill(int(lastAnalysisStarted), int(end))
+		if stopRequested() {
+			return
+		}
+		lastAnalysisStarted = end
+
+		blockCount = worker.getBlockCount()
 	}
 
 	workers := make(chan struct{}, N_WORKERS)
@@ -259,8 +421,24 @@ func doLiveAnalysis(height int) {
 		workers <- struct{}{}
 	}
 
-	heightInRangeOfTip := (blockCount - lastAnalysisStarted) <= MIN_DIST_FROM_TIP
+	tracker := newChainTracker()
+
+	notifier := newBlockNotifier()
+	defer notifier.close()
+
+	go keepRollupsFresh()
+
+	heightInRangeOfTip := lastAnalysisStarted > blockCount-MIN_DIST_FROM_TIP
 	for {
+		// On shutdown, wait for blocks being analyzed to be stored.
+		if stopRequested() {
+			for i := 0; i < N_WORKERS; i++ {
+				<-workers
+			}
+			log.Printf("Live analysis stopped, next height is %v\n", lastAnalysisStarted)
+			return
+		}
+
 		// Check if any workers are free.
 		select {
 		case <-workers:
@@ -269,50 +447,87 @@ func doLiveAnalysis(height int) {
 			continue
 		}
 
-		if heightInRangeOfTip {
-			time.Sleep(500 * time.Millisecond)
-			blockCount, err = worker.client.GetBlockCount()
-			if err != nil {
-				fatal("Error with getblockcount RPC: ", err)
+		// Close to the tip, make sure the block the next one builds on is still in the best chain.
+		if blockCount-lastAnalysisStarted < MAX_REORG_DEPTH {
+			if tracker.isPending(lastAnalysisStarted - 1) {
+				// Its hash isn't known until it has been stored.
+				workers <- struct{}{}
+				time.Sleep(500 * time.Millisecond)
+				continue
+			}
+
+			if fork, ok := worker.findReorg(tracker, lastAnalysisStarted-1); ok {
+				// Wait for all other workers to finish before touching stored data.
+				for i := 0; i < N_WORKERS-1; i++ {
+					<-workers
+				}
+
+				// Stored data for heights in (fork, lastAnalysisStarted) is removed so they are analyzed again on the new branch.
+				rollbackBlocks(fork, lastAnalysisStarted)
+				tracker.forgetAbove(fork)
+				lastAnalysisStarted = fork + 1
+
+				for i := 0; i < N_WORKERS-1; i++ {
+					workers <- struct{}{}
+				}
 			}
+		}
+
+		if heightInRangeOfTip {
+			notifier.wait()
+			blockCount = worker.getBlockCount()
 			workers <- struct{}{}
 		} else {
-			go func(blockHeight int64) {
-				analyzeBlockLive(blockHeight)
+			// Close to the tip, blocks are fetched by the hash of the block that builds on the stored one.
+			hash := ""
+			if blockCount-lastAnalysisStarted < MAX_REORG_DEPTH {
+				var ok bool
+				hash, ok = worker.nextBlockHash(tracker, lastAnalysisStarted)
+				if !ok {
+					// The chain changed under us, the check above finds the fork point next time around.
+					blockCount = worker.getBlockCount()
+					heightInRangeOfTip = lastAnalysisStarted > blockCount-MIN_DIST_FROM_TIP
+					workers <- struct{}{}
+					continue
+				}
+			}
+
+			tracker.start(lastAnalysisStarted)
+			go func(blockHeight int64, hash string) {
+				analyzeBlockLive(blockHeight, hash, tracker)
 				workers <- struct{}{}
-			}(lastAnalysisStarted)
+			}(lastAnalysisStarted, hash)
 
 			lastAnalysisStarted += 1
 		}
 
-		heightInRangeOfTip = (blockCount - lastAnalysisStarted) <= MIN_DIST_FROM_TIP
+		heightInRangeOfTip = lastAnalysisStarted > blockCount-MIN_DIST_FROM_TIP
 	}
 }
 
 // analyzeBlock uses the getblockstats RPC to compute metrics of a single block.
 // It then stores the results in a database (and json file if desired).
-func analyzeBlockLive(blockHeight int64) {
-	worker := setupWorker(time.Now().Format("01-02:15:04"), int(blockHeight))
-	defer worker.shutdown()
+// If hash is set, the block with that hash is analyzed instead of whatever is at the height by then.
+func analyzeBlockLive(blockHeight int64, hash string, tracker *chainTracker) {
+	worker := setupWorker()
 
 	start := time.Now()
 
-	// Record progress in file.
-	logProgressToFile(int(blockHeight), int(blockHeight), int(blockHeight), worker.workFile)
-
-	// Use getblockstats RPC and merge results into the metrics struct.
-	blockStatsRes, err := worker.client.GetBlockStats(blockHeight, nil)
-	if err != nil {
-		fatal("Error with getblockstats RPC: ", err)
+	var blockStats BlockStats
+	if hash != "" {
+		blockStats = worker.getBlockStats(hash)
+	} else {
+		blockStats = worker.getBlockStats(blockHeight)
 	}
-	blockStats := BlockStats{blockStatsRes}
 
 	// Insert into database.
 	ok := worker.insert(blockStats)
 	if !ok {
 		log.Printf("DB write failed!")
+		tracker.abandon(blockHeight)
 		return
 	}
+	tracker.record(blockHeight, blockStats.Hash)
 
 	log.Printf("Done with block %v after %v\n", blockHeight, time.Since(start))
 }
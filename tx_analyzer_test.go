@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// progressSnapshot reads all progress records in WORKER_PROGRESS_DIR by file name, leaving out lock and temporary files.
+func progressSnapshot(t *testing.T) map[string]progressRecord {
+	paths, err := filepath.Glob(WORKER_PROGRESS_DIR + "/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := make(map[string]progressRecord)
+	for _, path := range paths {
+		if strings.HasSuffix(path, ".lock") || strings.HasSuffix(path, ".tmp") {
+			continue
+		}
+		record, err := readProgress(path)
+		if err != nil {
+			t.Errorf("reading %v: %v", path, err)
+			continue
+		}
+		records[filepath.Base(path)] = record
+	}
+	return records
+}
+
+// writeOldRecord leaves the record of a backfill that died halfway through [0, 100).
+func writeOldRecord(t *testing.T) {
+	err := writeProgress(WORKER_PROGRESS_DIR+"/chunk-old-0-100", progressRecord{
+		Version: PROGRESS_FORMAT_VERSION,
+		Start:   0,
+		Last:    50,
+		End:     100,
+		Worker:  0,
+		Lock:    "chunk-old.lock",
+		Created: time.Now(),
+		Updated: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoveryReplacesRecords(t *testing.T) {
+	useBackfillSettings(t)
+	resetStopping(t)
+	fake := newFakeBitcoind(t)
+	stored := useMemorySink(t)
+
+	savedJSONDir := JSON_DIR
+	t.Cleanup(func() { JSON_DIR = savedJSONDir })
+	JSON_DIR = t.TempDir()
+
+	writeOldRecord(t)
+
+	// By the time blocks are fetched, [50, 100) must be recorded by new records alone.
+	var once sync.Once
+	var during map[string]progressRecord
+	fake.status = func(batch bool, heights []int64) int {
+		once.Do(func() { during = progressSnapshot(t) })
+		return 200
+	}
+
+	recoverFromFailure()
+
+	if _, ok := during["chunk-old-0-100"]; ok {
+		t.Error("claimed record still there after recovery started fetching")
+	}
+	var covered []heightRange
+	for _, record := range during {
+		covered = append(covered, heightRange{int64(record.Last), int64(record.End)})
+	}
+	sort.Slice(covered, func(i, j int) bool { return covered[i].Start < covered[j].Start })
+	if merged := mergeRanges(covered); len(merged) != 1 || merged[0] != (heightRange{50, 100}) {
+		t.Errorf("records while fetching cover %v, want [50, 100)", merged)
+	}
+
+	for height := int64(50); height < 100; height++ {
+		if !stored.has(height) {
+			t.Errorf("height %v wasn't recovered", height)
+		}
+	}
+	if stored.has(49) {
+		t.Error("recovered height 49, which was recorded as done")
+	}
+
+	if left := progressSnapshot(t); len(left) > 0 {
+		t.Errorf("progress records left after recovery: %v", left)
+	}
+	if locks, _ := filepath.Glob(WORKER_PROGRESS_DIR + "/*.lock"); len(locks) > 0 {
+		t.Errorf("lock files left after recovery: %v", locks)
+	}
+}
+
+// A recovery that dies before it has recorded the ranges it claimed must leave the old records behind.
+// recoverFromFailure exits the process on errors, so it runs in a child process.
+func TestRecoveryCrashKeepsRecords(t *testing.T) {
+	if dir := os.Getenv("RECOVERY_CRASH_DIR"); dir != "" {
+		useBackfillSettings(t)
+		newFakeBitcoind(t)
+		useMemorySink(t)
+		WORKER_PROGRESS_DIR, JSON_DIR = dir, t.TempDir()
+
+		// Directories in place of the lock file of the new records make writing them fail.
+		for _, at := range []time.Time{time.Now(), time.Now().Add(time.Minute)} {
+			os.Mkdir(fmt.Sprintf("%v/chunk-%v-%v.lock", dir, at.Format("01-02:15:04"), os.Getpid()), 0777)
+		}
+
+		recoverFromFailure()
+		return
+	}
+
+	useBackfillSettings(t)
+	writeOldRecord(t)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRecoveryCrashKeepsRecords$")
+	cmd.Env = append(os.Environ(), "RECOVERY_CRASH_DIR="+WORKER_PROGRESS_DIR)
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("recovery didn't fail writing new records:\n%s", output)
+	}
+
+	if _, ok := progressSnapshot(t)["chunk-old-0-100"]; !ok {
+		t.Errorf("claimed record removed before its replacement was written:\n%s", output)
+	}
+}
+
+func TestCatchUpEndStaysOutOfReorgReach(t *testing.T) {
+	saved := MIN_DIST_FROM_TIP
+	t.Cleanup(func() { MIN_DIST_FROM_TIP = saved })
+
+	tests := []struct {
+		minDist, blockCount, want int64
+	}{
+		{6, 700000, 700000 - MAX_REORG_DEPTH + 1},
+		{0, 700000, 700000 - MAX_REORG_DEPTH + 1},
+		{MAX_REORG_DEPTH + 50, 700000, 700000 - MAX_REORG_DEPTH - 49},
+	}
+
+	for _, test := range tests {
+		MIN_DIST_FROM_TIP = test.minDist
+		end := catchUpEnd(test.blockCount)
+		if end != test.want {
+			t.Errorf("-tipdist=%v: catchUpEnd(%v) = %v, want %v", test.minDist, test.blockCount, end, test.want)
+		}
+		// Live analysis checks the parents of blocks closer to the tip than MAX_REORG_DEPTH.
+		if test.blockCount-end >= MAX_REORG_DEPTH && test.minDist < MAX_REORG_DEPTH {
+			t.Errorf("-tipdist=%v: height %v is left to live analysis without a reorg check", test.minDist, end)
+		}
+	}
+}
@@ -102,64 +102,77 @@ func (metrics BlockStats) transformToDashboardData() DashboardDataV2 {
 	data.Mto_output_count = metrics.Mto_output_count
 	data.Mto_total_value = metrics.Mto_total_value
 
-	// Derived added below /////////////////////////////////////////////////////
-	data.Percent_txs_by_output_count = make([]float64, len(data.Txs_by_output_count))
-	data.Dust_output_percentages = make([]float64, len(data.Dust_output_count))
-	if data.Num_outputs != 0 {
-		for i := 0; i < len(data.Txs_by_output_count); i++ {
-			data.Percent_txs_by_output_count[i] = float64(data.Txs_by_output_count[i]) / float64(data.Num_outputs)
-		}
-		for i := 0; i < len(data.Dust_output_percentages); i++ {
-			data.Dust_output_percentages[i] = float64(data.Dust_output_count[i]) / float64(data.Num_outputs)
-		}
-	}
+	data.computeDerived()
 
-	data.Txs_spending_native_sw_outputs = metrics.TxsSpendingNativeP2WPKHOutputs + metrics.TxsSpendingNativeP2WSHOutputs
-	data.Txs_spending_nested_sw_outputs = metrics.TxsSpendingNestedP2WPKHOutputs + metrics.TxsSpendingNestedP2WSHOutputs
-
-	data.Num_txs_creating_native_segwit_outputs = metrics.TxsCreatingP2WPKHOutputs + metrics.TxsCreatingP2WSHOutputs
-	if metrics.Txs != 0 {
-		data.Percent_txs_signalling_opt_in_RBF = float64(metrics.TxsSignallingOptInRBF) / float64(metrics.Txs)
-		data.Percent_txs_batching = float64(metrics.TxsBatching) / float64(metrics.Txs)
-		data.Percent_txs_consolidating = float64(metrics.TxsConsolidating) / float64(metrics.Txs)
-		data.Percent_txs_creating_native_segwit_outputs = float64(metrics.TxsCreatingP2WPKHOutputs+metrics.TxsCreatingP2WSHOutputs) / float64(metrics.Txs)
-		data.Percent_txs_creating_P2WSH_outputs = float64(metrics.TxsCreatingP2WSHOutputs) / float64(metrics.Txs)
-		data.Percent_txs_creating_P2WPKH_outputs = float64(metrics.TxsCreatingP2WPKHOutputs) / float64(metrics.Txs)
-
-		data.Percent_txs_spending_native_segwit_outputs = float64(metrics.TxsSpendingNativeP2WPKHOutputs+metrics.TxsSpendingNativeP2WSHOutputs) / float64(metrics.Txs)
-		data.Percent_txs_spending_nested_segwit_outputs = float64(metrics.TxsSpendingNestedP2WPKHOutputs+metrics.TxsSpendingNestedP2WSHOutputs) / float64(metrics.Txs)
-		data.Percent_txs_spending_native_P2WPKH_outputs = float64(metrics.TxsSpendingNativeP2WPKHOutputs) / float64(metrics.Txs)
-		data.Percent_txs_spending_native_P2WSH_outputs = float64(metrics.TxsSpendingNativeP2WSHOutputs) / float64(metrics.Txs)
-		data.Percent_txs_spending_nested_P2WPKH_outputs = float64(metrics.TxsSpendingNestedP2WPKHOutputs) / float64(metrics.Txs)
-		data.Percent_txs_spending_nested_P2WSH_outputs = float64(metrics.TxsSpendingNestedP2WSHOutputs) / float64(metrics.Txs)
-		data.Percent_txs_spending_P2WSH_outputs = float64(metrics.TxsSpendingNativeP2WSHOutputs+metrics.TxsSpendingNestedP2WSHOutputs) / float64(metrics.Txs)
-		data.Percent_txs_spending_P2WPKH_outputs = float64(metrics.TxsSpendingNativeP2WPKHOutputs+metrics.TxsSpendingNestedP2WPKHOutputs) / float64(metrics.Txs)
-		data.Percent_txs_that_are_segwit_txs = float64(metrics.SegWitTxs) / float64(metrics.Txs)
+	return data
+}
 
+// ratio returns a / b, or 0 if b is 0.
+func ratio(a, b int64) float64 {
+	if b == 0 {
+		return 0
 	}
+	return float64(a) / float64(b)
+}
 
-	if metrics.Ins != 0 {
-		data.Percent_of_inputs_spending_nested_P2WPKH_output = float64(metrics.NestedP2WPKHOutputsSpent) / float64(metrics.Ins)
-		data.Percent_of_inputs_spending_native_P2WPKH_outputs = float64(metrics.NativeP2WPKHOutputsSpent) / float64(metrics.Ins)
-		data.Percent_of_inputs_spending_P2WPKH_outputs = float64(metrics.NativeP2WPKHOutputsSpent+metrics.NestedP2WPKHOutputsSpent) / float64(metrics.Ins)
-		data.Percent_of_inputs_spending_nested_P2WSH_outputs = float64(metrics.NestedP2WSHOutputsSpent) / float64(metrics.Ins)
-		data.Percent_of_inputs_spending_native_P2WSH_outputs = float64(metrics.NativeP2WSHOutputsSpent) / float64(metrics.Ins)
-		data.Percent_of_inputs_spending_P2WSH_outputs = float64(metrics.NativeP2WSHOutputsSpent+metrics.NestedP2WSHOutputsSpent) / float64(metrics.Ins)
-		data.Percent_of_inputs_spending_native_sw_outputs = float64(metrics.NativeP2WSHOutputsSpent+metrics.NativeP2WSHOutputsSpent) / float64(metrics.Ins)
-		data.Percent_inputs_consolidated = float64(metrics.OutputsConsolidated) / float64(metrics.Ins)
-	}
+// computeDerived (re)computes all derived fields from the fields that come straight from getblockstats,
+// so stored rows can be fixed without asking bitcoind again.
+func (data *DashboardDataV2) computeDerived() {
+	data.Version = CURRENT_VERSION_NUMBER
 
-	if metrics.SegWitTxs != 0 {
-		data.Percent_sw_txs_that_are_native_sw = float64(metrics.TxsSpendingNativeP2WSHOutputs+metrics.TxsSpendingNativeP2WPKHOutputs) / float64(metrics.SegWitTxs)
+	data.Percent_txs_by_output_count = make([]float64, len(data.Txs_by_output_count))
+	for i := 0; i < len(data.Txs_by_output_count); i++ {
+		data.Percent_txs_by_output_count[i] = ratio(data.Txs_by_output_count[i], data.Num_txs)
+	}
+	data.Dust_output_percentages = make([]float64, len(data.Dust_output_count))
+	for i := 0; i < len(data.Dust_output_count); i++ {
+		data.Dust_output_percentages[i] = ratio(data.Dust_output_count[i], data.Num_outputs)
 	}
 
-	return data
+	data.Txs_spending_native_sw_outputs = data.Txs_spending_native_p2wpkh_outputs + data.Txs_spending_native_p2wsh_outputs
+	data.Txs_spending_nested_sw_outputs = data.Txs_spending_nested_p2wpkh_outputs + data.Txs_spending_nested_p2wsh_outputs
+	data.Num_txs_creating_native_segwit_outputs = data.Txs_creating_P2WPKH + data.Txs_creating_P2WSH
+
+	data.Percent_new_outs_P2WPKH_outputs = ratio(data.New_P2WPKH_outputs, data.Num_outputs)
+	data.Percent_new_outs_P2WSH_outputs = ratio(data.New_P2WSH_outputs, data.Num_outputs)
+
+	data.Percent_txs_signalling_opt_in_RBF = ratio(data.Txs_signalling_opt_in_rbf, data.Num_txs)
+	data.Percent_txs_batching = ratio(data.Batching_txs, data.Num_txs)
+	data.Percent_txs_consolidating = ratio(data.Consolidating_txs, data.Num_txs)
+	data.Percent_txs_creating_native_segwit_outputs = ratio(data.Num_txs_creating_native_segwit_outputs, data.Num_txs)
+	data.Percent_txs_creating_P2WSH_outputs = ratio(data.Txs_creating_P2WSH, data.Num_txs)
+	data.Percent_txs_creating_P2WPKH_outputs = ratio(data.Txs_creating_P2WPKH, data.Num_txs)
+
+	data.Percent_txs_spending_native_segwit_outputs = ratio(data.Txs_spending_native_sw_outputs, data.Num_txs)
+	data.Percent_txs_spending_nested_segwit_outputs = ratio(data.Txs_spending_nested_sw_outputs, data.Num_txs)
+	data.Percent_txs_spending_native_P2WPKH_outputs = ratio(data.Txs_spending_native_p2wpkh_outputs, data.Num_txs)
+	data.Percent_txs_spending_native_P2WSH_outputs = ratio(data.Txs_spending_native_p2wsh_outputs, data.Num_txs)
+	data.Percent_txs_spending_nested_P2WPKH_outputs = ratio(data.Txs_spending_nested_p2wpkh_outputs, data.Num_txs)
+	data.Percent_txs_spending_nested_P2WSH_outputs = ratio(data.Txs_spending_nested_p2wsh_outputs, data.Num_txs)
+	data.Percent_txs_spending_P2WSH_outputs = ratio(data.Txs_spending_native_p2wsh_outputs+data.Txs_spending_nested_p2wsh_outputs, data.Num_txs)
+	data.Percent_txs_spending_P2WPKH_outputs = ratio(data.Txs_spending_native_p2wpkh_outputs+data.Txs_spending_nested_p2wpkh_outputs, data.Num_txs)
+	data.Percent_txs_that_are_segwit_txs = ratio(data.Num_segwit_txs, data.Num_txs)
+
+	data.Percent_of_inputs_spending_nested_P2WPKH_output = ratio(data.Nested_P2WPKH_outputs_spent, data.Num_inputs)
+	data.Percent_of_inputs_spending_native_P2WPKH_outputs = ratio(data.Native_P2WPKH_outputs_spent, data.Num_inputs)
+	data.Percent_of_inputs_spending_P2WPKH_outputs = ratio(data.Native_P2WPKH_outputs_spent+data.Nested_P2WPKH_outputs_spent, data.Num_inputs)
+	data.Percent_of_inputs_spending_nested_P2WSH_outputs = ratio(data.Nested_P2WSH_outputs_spent, data.Num_inputs)
+	data.Percent_of_inputs_spending_native_P2WSH_outputs = ratio(data.Native_P2WSH_outputs_spent, data.Num_inputs)
+	data.Percent_of_inputs_spending_P2WSH_outputs = ratio(data.Native_P2WSH_outputs_spent+data.Nested_P2WSH_outputs_spent, data.Num_inputs)
+	data.Percent_of_inputs_spending_native_sw_outputs = ratio(data.Native_P2WPKH_outputs_spent+data.Native_P2WSH_outputs_spent, data.Num_inputs)
+	data.Percent_of_inputs_spending_nested_sw_outputs = ratio(data.Nested_P2WPKH_outputs_spent+data.Nested_P2WSH_outputs_spent, data.Num_inputs)
+	data.Percent_inputs_consolidated = ratio(data.Outputs_consolidated, data.Num_inputs)
+
+	data.Percent_sw_txs_that_are_native_sw = ratio(data.Txs_spending_native_sw_outputs, data.Num_segwit_txs)
 }
 
 // Custom struct type for custom struct tags and to add derived fields (e.g. all the 'percentage' fields)
 type DashboardDataV2 struct {
 	Id int64 `json:"id,omit_empty" sql:",notnull"`
 
+	// Same as Data.Version, which is what JSON backups store.
+	Version int64 `json:"-" sql:",notnull,default:2"`
+
 	Avg_fee      int64 `json:"avg_fee" sql:",notnull"`
 	Avg_fee_rate int64 `json:"avg_fee_rate" sql:",notnull"`
 	Avg_tx_size  int64 `json:"avg_tx_size" sql:",notnull"`
@@ -275,3 +288,19 @@ type DashboardDataV2 struct {
 	Percent_txs_consolidating         float64 `json:"percent_txs_consolidating" sql:",notnull"`
 	Percent_txs_batching              float64 `json:"percent_txs_batching" sql:",notnull"`
 }
+
+// StaleBlock keeps the stats of a block that was stored and then re-organized out of the best chain.
+// Replaced_by_* is the block at the same height in the new best chain, or the new tip if that chain is shorter.
+type StaleBlock struct {
+	tableName struct{} `sql:"stale_blocks"`
+
+	Hash   string `json:"hash" sql:",pk"`
+	Height int64  `json:"height" sql:",notnull"`
+
+	Replaced_by_height int64  `json:"replaced_by_height" sql:",notnull"`
+	Replaced_by_hash   string `json:"replaced_by_hash" sql:",notnull"`
+
+	Detected_at int64 `json:"detected_at" sql:",notnull"`
+
+	DashboardDataRow DashboardDataV2 `json:"dashboard_data" sql:",notnull"`
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestComputeDerived(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  DashboardDataV2
+		want map[string]interface{}
+	}{
+		{
+			name: "segwit spends",
+			raw: DashboardDataV2{
+				Num_txs:                            10,
+				Num_inputs:                         20,
+				Num_outputs:                        40,
+				Num_segwit_txs:                     8,
+				Txs_spending_native_p2wpkh_outputs: 3,
+				Txs_spending_native_p2wsh_outputs:  2,
+				Txs_spending_nested_p2wpkh_outputs: 1,
+				Txs_spending_nested_p2wsh_outputs:  1,
+			},
+			want: map[string]interface{}{
+				// P2WSH spends are counted once.
+				"Txs_spending_native_sw_outputs":             int64(5),
+				"Percent_txs_spending_native_segwit_outputs": 0.5,
+				"Txs_spending_nested_sw_outputs":             int64(2),
+				"Percent_txs_spending_nested_segwit_outputs": 0.2,
+				"Percent_txs_spending_P2WSH_outputs":         0.3,
+				"Percent_txs_spending_P2WPKH_outputs":        0.4,
+				"Percent_sw_txs_that_are_native_sw":          0.625,
+				"Percent_txs_that_are_segwit_txs":            0.8,
+			},
+		},
+		{
+			name: "per transaction percentages",
+			raw: DashboardDataV2{
+				Num_txs:                   20,
+				Num_inputs:                50,
+				Num_outputs:               100,
+				Txs_signalling_opt_in_rbf: 5,
+				Batching_txs:              4,
+				Consolidating_txs:         2,
+				Txs_creating_P2WPKH:       6,
+				Txs_creating_P2WSH:        4,
+			},
+			want: map[string]interface{}{
+				"Percent_txs_signalling_opt_in_RBF":          0.25,
+				"Percent_txs_batching":                       0.2,
+				"Percent_txs_consolidating":                  0.1,
+				"Num_txs_creating_native_segwit_outputs":     int64(10),
+				"Percent_txs_creating_native_segwit_outputs": 0.5,
+				"Percent_txs_creating_P2WPKH_outputs":        0.3,
+				"Percent_txs_creating_P2WSH_outputs":         0.2,
+			},
+		},
+		{
+			name: "outputs and inputs",
+			raw: DashboardDataV2{
+				Num_txs:                     10,
+				Num_inputs:                  40,
+				Num_outputs:                 50,
+				New_P2WPKH_outputs:          10,
+				New_P2WSH_outputs:           5,
+				Outputs_consolidated:        10,
+				Nested_P2WPKH_outputs_spent: 4,
+				Native_P2WSH_outputs_spent:  8,
+				Txs_by_output_count:         []int64{2, 5, 3},
+				Dust_output_count:           []int64{5, 0},
+			},
+			want: map[string]interface{}{
+				"Percent_new_outs_P2WPKH_outputs":                  0.2,
+				"Percent_new_outs_P2WSH_outputs":                   0.1,
+				"Percent_inputs_consolidated":                      0.25,
+				"Percent_of_inputs_spending_nested_P2WPKH_output":  0.1,
+				"Percent_of_inputs_spending_native_P2WSH_outputs":  0.2,
+				"Percent_of_inputs_spending_nested_sw_outputs":     0.1,
+				"Percent_of_inputs_spending_native_sw_outputs":     0.2,
+				"Percent_txs_by_output_count":                      []float64{0.2, 0.5, 0.3},
+				"Dust_output_percentages":                          []float64{0.1, 0},
+				"Percent_of_inputs_spending_P2WSH_outputs":         0.2,
+				"Percent_of_inputs_spending_native_P2WPKH_outputs": 0.0,
+			},
+		},
+		{
+			name: "nothing to divide by",
+			raw: DashboardDataV2{
+				Txs_spending_native_p2wpkh_outputs: 1,
+			},
+			want: map[string]interface{}{
+				"Txs_spending_native_sw_outputs":             int64(1),
+				"Percent_txs_spending_native_segwit_outputs": 0.0,
+				"Percent_sw_txs_that_are_native_sw":          0.0,
+				"Percent_new_outs_P2WPKH_outputs":            0.0,
+				"Percent_inputs_consolidated":                0.0,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := test.raw
+			data.computeDerived()
+
+			if data.Version != CURRENT_VERSION_NUMBER {
+				t.Errorf("Version = %v, want %v", data.Version, CURRENT_VERSION_NUMBER)
+			}
+
+			value := reflect.ValueOf(data)
+			for field, want := range test.want {
+				got := value.FieldByName(field)
+				if !got.IsValid() {
+					t.Fatalf("no field %v", field)
+				}
+				if !reflect.DeepEqual(got.Interface(), want) {
+					t.Errorf("%v = %v, want %v", field, got.Interface(), want)
+				}
+			}
+		})
+	}
+}
+
+// derivedRow returns a row whose derived values are up to date.
+func derivedRow(height int64) DashboardDataV2 {
+	row := DashboardDataV2{
+		Height:                            height,
+		Hash:                              fakeBlockStats(height).Hash,
+		Num_txs:                           10,
+		Num_inputs:                        20,
+		Num_outputs:                       30,
+		Txs_spending_native_p2wsh_outputs: 2,
+		New_P2WSH_outputs:                 3,
+	}
+	row.computeDerived()
+	return row
+}
+
+func TestDiffFieldsIgnoresVersion(t *testing.T) {
+	stored := derivedRow(1)
+	stored.Version = 2
+	if diff := diffFields(stored, derivedRow(1)); len(diff) > 0 {
+		t.Errorf("version-only difference reported as %v", diff)
+	}
+
+	stored.Percent_new_outs_P2WSH_outputs = 0
+	if diff := diffFields(stored, derivedRow(1)); !reflect.DeepEqual(diff, []string{"Percent_new_outs_P2WSH_outputs"}) {
+		t.Errorf("diff = %v, want [Percent_new_outs_P2WSH_outputs]", diff)
+	}
+}
+
+func TestRecomputeJSONCountsValueChanges(t *testing.T) {
+	savedJSONDir := JSON_DIR
+	t.Cleanup(func() { JSON_DIR = savedJSONDir })
+	JSON_DIR = t.TempDir()
+
+	// Up to date.
+	storeDataAsFile(Data{CURRENT_VERSION_NUMBER, derivedRow(1)})
+	// An old version with the same values, rewritten but not a change.
+	old := derivedRow(2)
+	old.Version = 2
+	storeDataAsFile(Data{2, old})
+	// A value that is off, from before native segwit spends were fixed.
+	wrong := derivedRow(3)
+	wrong.Txs_spending_native_sw_outputs = 4
+	storeDataAsFile(Data{CURRENT_VERSION_NUMBER, wrong})
+
+	upToDate, err := ioutil.ReadFile(JSON_DIR + "/1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checked, changed := recomputeJSON(0, 10)
+	if checked != 3 || changed != 1 {
+		t.Errorf("recomputeJSON checked %v and changed %v, want 3 and 1", checked, changed)
+	}
+
+	if contents, _ := ioutil.ReadFile(JSON_DIR + "/1.json"); string(contents) != string(upToDate) {
+		t.Errorf("up to date backup was rewritten")
+	}
+	for height := int64(2); height <= 3; height++ {
+		data, ok := readDataFile(height)
+		if !ok {
+			t.Fatalf("backup %v is gone", height)
+		}
+		if data.Version != CURRENT_VERSION_NUMBER {
+			t.Errorf("backup %v has version %v, want %v", height, data.Version, CURRENT_VERSION_NUMBER)
+		}
+		if diff := diffFields(data.DashboardDataRow, derivedRow(height)); len(diff) > 0 {
+			t.Errorf("backup %v differs after recomputing: %v", height, diff)
+		}
+	}
+}
+
+func TestRecomputeJSONStopsWhenAsked(t *testing.T) {
+	resetStopping(t)
+	savedJSONDir := JSON_DIR
+	t.Cleanup(func() { JSON_DIR = savedJSONDir })
+	JSON_DIR = t.TempDir()
+
+	old := derivedRow(1)
+	old.Version = 2
+	storeDataAsFile(Data{2, old})
+
+	close(stopping)
+	if checked, _ := recomputeJSON(0, 10); checked != 0 {
+		t.Errorf("recomputeJSON checked %v backups after a stop was requested", checked)
+	}
+	if data, _ := readDataFile(1); data.Version != 2 {
+		t.Errorf("backup was rewritten with version %v after a stop was requested", data.Version)
+	}
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -24,38 +26,57 @@ func storeDataAsFile(data Data) {
 	dataFile.Close()
 }
 
-// parseProgress takes in the contents of a worker-progress file
-// and returns the starting height, the last height completed, and the end height.
-func parseProgress(contents string) []int {
-	lines := strings.Split(contents, "\n")
-	result := make([]int, 0)
+// readDataFile reads the JSON backup stored for a given height.
+// The second return value is false if there is no backup for that height.
+func readDataFile(height int64) (Data, bool) {
+	data, err := decodeDataFile(fmt.Sprintf("%v/%v.json", JSON_DIR, height))
+	if os.IsNotExist(err) {
+		return data, false
+	}
+	if err != nil {
+		fatal("Error reading JSON backup: ", err)
+	}
 
-	for _, line := range lines {
-		split := strings.Split(line, "=")
+	return data, true
+}
 
-		if len(split) < 2 {
-			continue
-		}
-		height, err := strconv.Atoi(split[1])
-		if err != nil {
-			fatal("Error in parseProgress, strconv parsing: ", err)
-		}
+// decodeDataFile decodes a JSON backup file.
+func decodeDataFile(path string) (Data, error) {
+	var data Data
+
+	dataFile, err := os.Open(path)
+	if err != nil {
+		return data, err
+	}
+	defer dataFile.Close()
 
-		result = append(result, height)
+	err = json.NewDecoder(dataFile).Decode(&data)
+	if err != nil {
+		return data, fmt.Errorf("JSON decoding error in %v: %v", path, err)
 	}
+	data.DashboardDataRow.Version = data.Version
 
-	return result
+	return data, nil
 }
 
-// logProgressToFile records the progress of a worker to a given file.
-func logProgressToFile(start, last, end int, file *os.File) {
-	// Record progress in file.
-	progress := fmt.Sprintf("Start=%v\nLast=%v\nEnd=%v", start, last, end)
-	_, err := file.WriteAt([]byte(progress), 0)
-
+// storedJSONHeights returns the heights of all JSON backups in JSON_DIR, in ascending order.
+func storedJSONHeights() []int64 {
+	files, err := ioutil.ReadDir(JSON_DIR)
 	if err != nil {
-		fatal("Error logging progress: ", err)
+		fatal("Error reading JSON directory: ", err)
 	}
+
+	heights := make([]int64, 0, len(files))
+	for _, file := range files {
+		height, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), ".json"), 10, 64)
+		if err != nil || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		heights = append(heights, height)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+
+	return heights
 }
 
 // createDirIfNotExist creates a directory at a given path, unless it already exists.
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// A mismatch is a stored row that differs from what getblockstats returns now.
+type mismatch struct {
+	height int64
+	source string // "postgres" or "json"
+	fields []string
+}
+
+// diffFields compares two rows field by field and returns the names of the fields that differ.
+// Empty and nil arrays are treated as equal, since they don't survive Postgres and JSON the same way.
+// Version is skipped, it says how the row was computed, not what it contains.
+func diffFields(stored, fresh DashboardDataV2) []string {
+	storedVal := reflect.ValueOf(stored)
+	freshVal := reflect.ValueOf(fresh)
+	dataType := storedVal.Type()
+
+	diff := make([]string, 0)
+	for i := 0; i < dataType.NumField(); i++ {
+		if dataType.Field(i).Name == "Version" {
+			continue
+		}
+
+		a := storedVal.Field(i)
+		b := freshVal.Field(i)
+
+		if a.Kind() == reflect.Slice && a.Len() == 0 && b.Len() == 0 {
+			continue
+		}
+
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			diff = append(diff, dataType.Field(i).Name)
+		}
+	}
+
+	return diff
+}
+
+// verifyBlocks re-fetches stats for every height in [start, end) and compares them
+// with the rows stored in Postgres and the JSON backups. Mismatching heights and fields
+// are printed at the end, and fixed when repair is set.
+func verifyBlocks(start, end int64, repair bool) {
+	if end <= start {
+		worker := setupWorker()
+		end = worker.lastStoredHeight() + 1
+	}
+	log.Printf("Verifying stored blocks in [%v, %v)\n", start, end)
+	startTime := time.Now()
+
+	chunks := make(chan heightRange)
+	go func() {
+		defer close(chunks)
+		for _, r := range splitRanges([]heightRange{{start, end}}) {
+			select {
+			case chunks <- r:
+			case <-stopping:
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	mismatches := make([]mismatch, 0)
+
+	var wg sync.WaitGroup
+	wg.Add(N_WORKERS)
+	for i := 0; i < N_WORKERS; i++ {
+		go func() {
+			defer wg.Done()
+
+			worker := setupWorker()
+
+			for r := range chunks {
+				found := worker.verifyRange(r, repair)
+
+				mu.Lock()
+				mismatches = append(mismatches, found...)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(mismatches, func(i, j int) bool {
+		if mismatches[i].height != mismatches[j].height {
+			return mismatches[i].height < mismatches[j].height
+		}
+		return mismatches[i].source < mismatches[j].source
+	})
+
+	heights := make(map[int64]bool)
+	for _, m := range mismatches {
+		heights[m.height] = true
+		fmt.Printf("Height %v (%v): %v\n", m.height, m.source, strings.Join(m.fields, ", "))
+	}
+
+	action := "found"
+	if repair {
+		action = "repaired"
+	}
+	log.Printf("Verified %v blocks after %v, %v %v mismatches at %v heights\n", end-start, time.Since(startTime), action, len(mismatches), len(heights))
+}
+
+// verifyRange verifies the heights in one range, see verifyBlocks.
+func (worker *Worker) verifyRange(r heightRange, repair bool) []mismatch {
+	stored := make(map[int64]DashboardDataV2)
+	if USE_POSTGRES {
+		var rows []DashboardDataV2
+		err := retry("PG select", func() error {
+			return worker.pgClient.Model(&rows).Where("height >= ? AND height < ?", r.Start, r.End).Select()
+		})
+		if err != nil {
+			fatal("Error selecting stored blocks: ", err)
+		}
+
+		for _, row := range rows {
+			stored[row.Height] = row
+		}
+	}
+
+	mismatches := make([]mismatch, 0)
+	for _, blockStats := range worker.getBlockStatsRange(r.Start, r.End) {
+		fresh := blockStats.transformToDashboardData()
+		height := fresh.Height
+
+		if USE_POSTGRES {
+			row, ok := stored[height]
+			diff := []string{"missing"}
+			if ok {
+				diff = diffFields(row, fresh)
+			}
+
+			if len(diff) > 0 {
+				mismatches = append(mismatches, mismatch{height, "postgres", diff})
+				if repair {
+					worker.repairRow(fresh, ok)
+				}
+			}
+		}
+
+		if BACKUP_JSON {
+			data, ok := readDataFile(height)
+			diff := []string{"missing"}
+			if ok {
+				diff = diffFields(data.DashboardDataRow, fresh)
+			}
+
+			if len(diff) > 0 {
+				mismatches = append(mismatches, mismatch{height, "json", diff})
+				if repair {
+					storeDataAsFile(Data{CURRENT_VERSION_NUMBER, fresh})
+				}
+			}
+		}
+	}
+
+	return mismatches
+}
+
+// repairRow overwrites (or inserts) the Postgres row of a block with freshly computed stats.
+func (worker *Worker) repairRow(fresh DashboardDataV2, exists bool) {
+	err := retry("PG repair", func() error {
+		return worker.pgClient.RunInTransaction(func(tx *pg.Tx) error {
+			return updateRollups(tx, []int64{fresh.Height}, func() error {
+				if exists {
+					return tx.Update(&fresh)
+				}
+				return tx.Insert(&fresh)
+			})
+		})
+	})
+	if err != nil {
+		fatal("Error repairing stored block: ", err)
+	}
+}
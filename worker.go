@@ -1,115 +1,124 @@
 package main
 
 import (
+	"github.com/btcsuite/btcd/btcjson"
 	"github.com/btcsuite/btcd/rpcclient"
 
-	"fmt"
 	"github.com/go-pg/pg"
-	"github.com/go-pg/pg/orm"
 	"log"
-	"os"
-	"strings"
-	"time"
 )
 
 // A Worker contains all the components necessary to make RPC calls to bitcoind, and
 // to place data into PostgreSQL.
 type Worker struct {
-	client *rpcclient.Client
+	client      *rpcclient.Client
+	batchClient *batchRPCClient
 
-	// Fields specifically for PostgreSQL
+	// Shared by all backfill workers, nil outside of backfills.
+	limiter *concurrencyLimiter
+
+	// Used to read back stored blocks, nil without Postgres.
 	pgClient *pg.DB
-	pgBatch  dataBatch
 
-	workFile *os.File
+	// Rows waiting to be written to the sinks.
+	batch dataBatch
 }
 
-// Assumes enviroment variables: DB, DB_USERNAME, DB_PASSWORD, BITCOIND_HOST, BITCOIND_USERNAME, BITCOIND_PASSWORD, are all set.
-// PostgreSQL and bitcoind should already be started.
-func setupWorker(startTime string, id int) Worker {
-	workFileName := fmt.Sprintf("%v/worker-%v-%v", WORKER_PROGRESS_DIR, startTime, id)
-	// Create file to record progress in.
-	workFile, err := os.Create(workFileName)
-	if err != nil {
-		fatal("Error setting up workfile: ", err)
+// setupWorker creates a worker on top of the connection pools, see setupPools.
+// Workers are cheap, only their batch of rows to insert is their own.
+func setupWorker() Worker {
+	worker := Worker{
+		client:      nextRPCClient(),
+		batchClient: batchClientPool,
+		pgClient:    pgPool,
+		batch: dataBatch{
+			versions:          make([]int64, 0),
+			dashboardDataRows: make([]DashboardDataV2, 0),
+		},
 	}
 
-	BITCOIND_HOST, ok := os.LookupEnv("BITCOIND_HOST")
-	if !ok {
-		BITCOIND_HOST = "localhost:8332"
+	return worker
+}
+
+// limited runs an RPC call for the given number of blocks, and reports how it went to the backfill's concurrency limiter.
+func (worker *Worker) limited(blocks int, fn func() error) error {
+	if worker.limiter == nil {
+		return fn()
 	}
 
-	// Connect to local bitcoin core RPC server using HTTP POST mode.
-	connCfg := &rpcclient.ConnConfig{
-		Host: BITCOIND_HOST,
-		User: os.Getenv("BITCOIND_USERNAME"),
-		Pass: os.Getenv("BITCOIND_PASSWORD"),
+	return worker.limiter.do(blocks, fn)
+}
 
-		HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
-		DisableTLS:   true, // Bitcoin core does not provide TLS by default
-	}
-	// Notice the notification parameter is nil since notifications are
-	// not supported in HTTP POST mode.
-	client, err := rpcclient.New(connCfg, nil)
+// getBlockStats uses the getblockstats RPC to get the stats of a single block, retrying transient failures.
+// The block is given by its height in the best chain, or by its hash.
+func (worker *Worker) getBlockStats(hashOrHeight interface{}) BlockStats {
+	var blockStatsRes *btcjson.GetBlockStatsResult
+	err := retry("getblockstats", func() error {
+		return worker.limited(1, func() (err error) {
+			blockStatsRes, err = worker.client.GetBlockStats(hashOrHeight, nil)
+			return err
+		})
+	})
 	if err != nil {
-		fatal("Error connecting to bitcoin rpcclient", err)
-	}
-
-	DB_ADDR, ok := os.LookupEnv("DB_ADDR")
-	if !ok {
-		DB_ADDR = "localhost:5432"
+		fatal("Error with getblockstats RPC: ", err)
 	}
 
-	db := pg.Connect(&pg.Options{
-		Addr:     DB_ADDR,
-		User:     os.Getenv("DB_USERNAME"),
-		Password: os.Getenv("DB_PASSWORD"),
-		Database: os.Getenv("DB"),
-	})
+	return BlockStats{blockStatsRes}
+}
 
-	model := interface{}((*DashboardDataV2)(nil))
-	err = db.CreateTable(model, &orm.CreateTableOptions{
-		Temp:        false,
-		IfNotExists: true,
-	})
-	if err != nil {
-		fatal("Error creating Postgres table: ", err)
+// getBlockStatsRange gets the stats of all blocks in [start, end) with batched getblockstats calls.
+// Heights that fail inside a batch are retried one at a time.
+func (worker *Worker) getBlockStatsRange(start, end int64) []BlockStats {
+	stats := make([]BlockStats, 0, end-start)
+	if RPC_BATCH_SIZE <= 1 {
+		for height := start; height < end; height++ {
+			stats = append(stats, worker.getBlockStats(height))
+		}
+		return stats
 	}
 
-	// Prints out the queries created by go-pg.
-	if SHOW_QUERIES {
-		db.OnQueryProcessed(func(event *pg.QueryProcessedEvent) {
-			query, err := event.FormattedQuery()
-			if err != nil {
-				fatal("Error formatting processed query: ", err)
-			}
+	heights := make([]int64, 0, end-start)
+	for height := start; height < end; height++ {
+		heights = append(heights, height)
+	}
 
-			log.Printf("%s %s", time.Since(event.StartTime), query)
+	var results map[int64]*btcjson.GetBlockStatsResult
+	var failed map[int64]error
+	err := retry("batched getblockstats", func() error {
+		return worker.limited(len(heights), func() (err error) {
+			results, failed, err = worker.batchClient.getBlockStatsBatch(heights)
+			return err
 		})
+	})
+	if err != nil {
+		fatal("Error with batched getblockstats RPC: ", err)
 	}
 
-	worker := Worker{
-		client:   client,
-		pgClient: db,
-		pgBatch: dataBatch{
-			versions:          make([]int64, 0),
-			dashboardDataRows: make([]DashboardDataV2, 0),
-		},
-		workFile: workFile,
+	for _, height := range heights {
+		result, ok := results[height]
+		if !ok {
+			log.Printf("getblockstats for height %v failed in batch, retrying on its own: %v\n", height, failed[height])
+			stats = append(stats, worker.getBlockStats(height))
+			continue
+		}
+		stats = append(stats, BlockStats{result})
 	}
 
-	return worker
+	return stats
 }
 
-func (worker *Worker) shutdown() {
-	worker.client.Shutdown()
-	worker.pgClient.Close()
-
-	// Worker finished successfully so its progress record is unneeded.
-	err := os.Remove(worker.workFile.Name())
+// getBlockCount returns the height of bitcoind's best chain, retrying transient failures.
+func (worker *Worker) getBlockCount() int64 {
+	var blockCount int64
+	err := retry("getblockcount", func() (err error) {
+		blockCount, err = worker.client.GetBlockCount()
+		return err
+	})
 	if err != nil {
-		log.Printf("Error removing %v: %v\n", worker.workFile, err)
+		fatal("Error with getblockcount RPC: ", err)
 	}
+
+	return blockCount
 }
 
 // inserts a data from a single getblockstats call into the worker's DB
@@ -123,63 +132,36 @@ func (worker *Worker) insert(stats BlockStats) bool {
 }
 
 func (worker *Worker) insertData(data Data) bool {
-	err := worker.pgClient.Insert(&data.DashboardDataRow)
-	if err != nil {
-		// Skip duplicate values.
-		if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
-			log.Println("Skipping duplicate key at height: ", data.DashboardDataRow.Height)
-			return true
-		}
-
-		fatal("PG database insert failed! ", err)
-	}
-
-	log.Printf("\n\n STORED INTO POSTGRESQL \n\n")
-
-	if BACKUP_JSON {
-		storeDataAsFile(data)
-	}
+	writeBlocks([]Data{data})
 
 	return true
 }
 
 // setup the insertion of many BlockStats (stored internally)
-// uses batch insertion / bulk insertion capabilities of DB_USED whenever possible
-func (worker *Worker) batchInsert(stats BlockStats) {
-	worker.pgBatch.versions = append(worker.pgBatch.versions, CURRENT_VERSION_NUMBER)
-	worker.pgBatch.dashboardDataRows = append(worker.pgBatch.dashboardDataRows, stats.transformToDashboardData())
+// uses batch insertion / bulk insertion capabilities of the sinks whenever possible
+func (worker *Worker) batchInsert(row DashboardDataV2) {
+	worker.batch.versions = append(worker.batch.versions, CURRENT_VERSION_NUMBER)
+	worker.batch.dashboardDataRows = append(worker.batch.dashboardDataRows, row)
 }
 
 // actually do the write of batch created
 func (worker *Worker) commitBatchInsert() bool {
-	err := worker.pgClient.Insert(&worker.pgBatch.dashboardDataRows)
-	if err != nil {
-		// Skip duplicate values.
-		if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
-			log.Println("Skipping duplicate key in batch")
-			for _, row := range worker.pgBatch.dashboardDataRows {
-				worker.insertData(Data{CURRENT_VERSION_NUMBER, row})
-			}
-			return true
-		}
-
-		fatal("PG Commit Batch insert failed! ", err)
+	if len(worker.batch.dashboardDataRows) == 0 {
+		return true
 	}
 
-	log.Printf("\n\n STORED INTO POSTGRESQL \n\n")
-
-	if BACKUP_JSON {
-		for i, dashDataRow := range worker.pgBatch.dashboardDataRows {
-			storeDataAsFile(Data{
-				Version:          worker.pgBatch.versions[i],
-				DashboardDataRow: dashDataRow,
-			})
+	batch := make([]Data, len(worker.batch.dashboardDataRows))
+	for i, row := range worker.batch.dashboardDataRows {
+		batch[i] = Data{
+			Version:          worker.batch.versions[i],
+			DashboardDataRow: row,
 		}
 	}
+	writeBlocks(batch)
 
 	// Reset batch.
-	worker.pgBatch.versions = make([]int64, 0)
-	worker.pgBatch.dashboardDataRows = make([]DashboardDataV2, 0)
+	worker.batch.versions = make([]int64, 0)
+	worker.batch.dashboardDataRows = make([]DashboardDataV2, 0)
 
 	return true
 }
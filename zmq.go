@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/lightninglabs/gozmq"
+)
+
+// How often live analysis polls getblockcount when waiting for a new block.
+const POLL_INTERVAL = 500 * time.Millisecond
+
+// With ZMQ notifications we still poll occasionally, in case a notification got lost.
+const ZMQ_POLL_INTERVAL = 30 * time.Second
+const ZMQ_TIMEOUT = 5 * time.Second
+
+// A blockNotifier tells live analysis when bitcoind has a new block.
+// It listens to bitcoind's zmqpubhashblock publisher if BITCOIND_ZMQ is set,
+// and otherwise falls back to polling.
+type blockNotifier struct {
+	conn   *gozmq.Conn
+	blocks chan struct{}
+}
+
+// newBlockNotifier subscribes to the hashblock topic at the address in BITCOIND_ZMQ (e.g. tcp://127.0.0.1:28332).
+func newBlockNotifier() *blockNotifier {
+	notifier := &blockNotifier{}
+
+	addr, ok := os.LookupEnv("BITCOIND_ZMQ")
+	if !ok {
+		log.Println("BITCOIND_ZMQ not set, polling for new blocks.")
+		return notifier
+	}
+
+	conn, err := gozmq.Subscribe(addr, []string{"hashblock"}, ZMQ_TIMEOUT)
+	if err != nil {
+		fatal("Error subscribing to ZMQ block notifications: ", err)
+	}
+	log.Printf("Subscribed to ZMQ block notifications at %v\n", addr)
+
+	notifier.conn = conn
+	notifier.blocks = make(chan struct{}, 1)
+	go notifier.receive()
+
+	return notifier
+}
+
+func (notifier *blockNotifier) receive() {
+	for {
+		msg, err := notifier.conn.Receive(nil)
+		if err == io.EOF {
+			// Connection was closed by us.
+			return
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			// gozmq reconnects on its own after a timeout.
+			continue
+		}
+		if err != nil {
+			log.Println("Error receiving ZMQ notification: ", err)
+			continue
+		}
+
+		// Messages are [topic, body, sequence number].
+		if len(msg) < 2 || string(msg[0]) != "hashblock" {
+			continue
+		}
+
+		// Notifications don't need to queue up, getblockcount tells us how far to go.
+		select {
+		case notifier.blocks <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wait blocks until there may be a new block to analyze.
+func (notifier *blockNotifier) wait() {
+	if notifier.conn == nil {
+		select {
+		case <-stopping:
+		case <-time.After(POLL_INTERVAL):
+		}
+		return
+	}
+
+	select {
+	case <-notifier.blocks:
+	case <-stopping:
+	case <-time.After(ZMQ_POLL_INTERVAL):
+	}
+}
+
+func (notifier *blockNotifier) close() {
+	if notifier.conn != nil {
+		notifier.conn.Close()
+	}
+}
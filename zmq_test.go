@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// zmqPublisher is a minimal ZMTP 3.0 PUB socket standing in for bitcoind's zmqpubhashblock.
+type zmqPublisher struct {
+	listener net.Listener
+	conns    chan net.Conn
+}
+
+func newZMQPublisher(t *testing.T) *zmqPublisher {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	pub := &zmqPublisher{listener: listener, conns: make(chan net.Conn, 1)}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		if err := zmqHandshake(conn); err != nil {
+			t.Errorf("ZMQ handshake: %v", err)
+			conn.Close()
+			return
+		}
+		pub.conns <- conn
+	}()
+
+	return pub
+}
+
+func (pub *zmqPublisher) addr() string {
+	return "tcp://" + pub.listener.Addr().String()
+}
+
+// zmqHandshake does the NULL mechanism handshake as a PUB socket, and reads the subscription.
+func zmqHandshake(conn net.Conn) error {
+	greeting := make([]byte, 64)
+	greeting[0], greeting[9] = 0xff, 0x7f
+	greeting[10] = 3
+	copy(greeting[12:], "NULL")
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 64)); err != nil {
+		return err
+	}
+
+	ready := []byte{5}
+	ready = append(ready, "READY"...)
+	ready = append(ready, 11)
+	ready = append(ready, "Socket-Type"...)
+	ready = append(ready, 0, 0, 0, 3)
+	ready = append(ready, "PUB"...)
+	if err := zmqWriteFrame(conn, 4, ready); err != nil {
+		return err
+	}
+
+	// The subscriber's READY, then its subscription.
+	for i := 0; i < 2; i++ {
+		if _, err := zmqReadFrame(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func zmqWriteFrame(conn net.Conn, flag byte, body []byte) error {
+	_, err := conn.Write(append([]byte{flag, byte(len(body))}, body...))
+	return err
+}
+
+func zmqReadFrame(conn net.Conn) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	size := uint64(header[1])
+	if header[0]&2 != 0 {
+		long := make([]byte, 7)
+		if _, err := io.ReadFull(conn, long); err != nil {
+			return nil, err
+		}
+		size = binary.BigEndian.Uint64(append([]byte{header[1]}, long...))
+	}
+
+	body := make([]byte, size)
+	_, err := io.ReadFull(conn, body)
+	return body, err
+}
+
+// publish sends a message as bitcoind does: topic, body and sequence number.
+func (pub *zmqPublisher) publish(conn net.Conn, topic string, body []byte, seq uint32) error {
+	seqBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seqBytes, seq)
+
+	if err := zmqWriteFrame(conn, 1, []byte(topic)); err != nil {
+		return err
+	}
+	if err := zmqWriteFrame(conn, 1, body); err != nil {
+		return err
+	}
+	return zmqWriteFrame(conn, 0, seqBytes)
+}
+
+func TestBlockNotifierZMQ(t *testing.T) {
+	resetStopping(t)
+	pub := newZMQPublisher(t)
+	t.Setenv("BITCOIND_ZMQ", pub.addr())
+
+	notifier := newBlockNotifier()
+	defer notifier.close()
+
+	var conn net.Conn
+	select {
+	case conn = <-pub.conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("notifier didn't subscribe")
+	}
+
+	// Other topics don't count as a new block.
+	if err := pub.publish(conn, "hashtx", make([]byte, 32), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.publish(conn, "hashblock", make([]byte, 32), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		notifier.wait()
+		close(done)
+	}()
+
+	// Without the notification, wait would only return after ZMQ_POLL_INTERVAL.
+	select {
+	case <-done:
+	case <-time.After(ZMQ_POLL_INTERVAL / 2):
+		t.Fatal("wait didn't return on a hashblock notification")
+	}
+}
+
+func TestBlockNotifierPolling(t *testing.T) {
+	resetStopping(t)
+	t.Setenv("BITCOIND_ZMQ", "")
+	os.Unsetenv("BITCOIND_ZMQ")
+
+	notifier := newBlockNotifier()
+	defer notifier.close()
+
+	if notifier.conn != nil {
+		t.Fatal("subscribed to ZMQ without BITCOIND_ZMQ")
+	}
+
+	start := time.Now()
+	notifier.wait()
+	if elapsed := time.Since(start); elapsed < POLL_INTERVAL/2 || elapsed > 10*POLL_INTERVAL {
+		t.Errorf("polling wait took %v, want about %v", elapsed, POLL_INTERVAL)
+	}
+
+	// A shutdown ends the wait right away.
+	close(stopping)
+	start = time.Now()
+	notifier.wait()
+	if elapsed := time.Since(start); elapsed > POLL_INTERVAL/2 {
+		t.Errorf("wait took %v after shutdown", elapsed)
+	}
+}